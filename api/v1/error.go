@@ -0,0 +1,44 @@
+package v1
+
+import (
+	"fmt"
+	"strconv"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Returned when reading an offset that isn't in the log, either because it hasn't been written
+// yet or because it's below the log's lowest offset.
+type ErrOffsetOutOfRange struct {
+	Offset uint64
+}
+
+func (e ErrOffsetOutOfRange) Error() string {
+	return fmt.Sprintf("offset out of range: %d", e.Offset)
+}
+
+// Matches any ErrOffsetOutOfRange, whatever its offset, so callers can check for the error with
+// errors.Is(err, ErrOffsetOutOfRange{}).
+func (e ErrOffsetOutOfRange) Is(target error) bool {
+	_, ok := target.(ErrOffsetOutOfRange)
+	return ok
+}
+
+// Converts the error to an OutOfRange gRPC status, with the offset in the status's details so
+// that clients can tell which offset it was without parsing the message. gRPC servers use this
+// when the error is returned from a handler.
+func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
+	st := status.New(codes.OutOfRange, e.Error())
+	d := &errdetails.ErrorInfo{
+		Reason:   "OFFSET_OUT_OF_RANGE",
+		Domain:   "proglog",
+		Metadata: map[string]string{"offset": strconv.FormatUint(e.Offset, 10)},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
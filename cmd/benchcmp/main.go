@@ -0,0 +1,124 @@
+// Compares two runs of `go test -bench` and exits nonzero if any benchmark got slower by more
+// than a threshold. Usage:
+//
+//	go test -run xxx -bench . ./... > old.txt
+//	# make changes
+//	go test -run xxx -bench . ./... > new.txt
+//	benchcmp -threshold 10 old.txt new.txt
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	threshold := flag.Float64("threshold", 10, "percent slowdown in ns/op that counts as a regression")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: benchcmp [-threshold percent] old.txt new.txt\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	old, err := parseFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	cur, err := parseFile(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if regressions := compare(os.Stdout, old, cur, *threshold); regressions > 0 {
+		fmt.Printf("%d benchmark(s) regressed by more than %.1f%%\n", regressions, *threshold)
+		os.Exit(1)
+	}
+}
+
+func parseFile(name string) (map[string]float64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parse(f)
+}
+
+// Reads benchmark results from `go test -bench` output and returns each benchmark's ns/op. If a
+// benchmark was run more than once (e.g. with -count) its ns/op is averaged.
+func parse(r io.Reader) (map[string]float64, error) {
+	sums := map[string]float64{}
+	counts := map[string]int{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		// name, iterations, then value/unit pairs
+		for i := 2; i+1 < len(fields); i += 2 {
+			if fields[i+1] != "ns/op" {
+				continue
+			}
+			ns, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad ns/op %q", fields[0], fields[i])
+			}
+			sums[fields[0]] += ns
+			counts[fields[0]]++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	results := make(map[string]float64, len(sums))
+	for name, sum := range sums {
+		results[name] = sum / float64(counts[name])
+	}
+	return results, nil
+}
+
+// Writes a line per benchmark comparing old and cur ns/op, and returns how many got slower by
+// more than threshold percent. Benchmarks that are only in one of the runs are listed but
+// don't count as regressions.
+func compare(w io.Writer, old, cur map[string]float64, threshold float64) (regressions int) {
+	names := make([]string, 0, len(old))
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range cur {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o, inOld := old[name]
+		n, inNew := cur[name]
+		switch {
+		case !inNew:
+			fmt.Fprintf(w, "%-50s %14.1f %14s\n", name, o, "-")
+		case !inOld:
+			fmt.Fprintf(w, "%-50s %14s %14.1f\n", name, "-", n)
+		default:
+			delta := (n - o) / o * 100
+			mark := ""
+			if delta > threshold {
+				mark = "  REGRESSION"
+				regressions++
+			}
+			fmt.Fprintf(w, "%-50s %14.1f %14.1f %+8.1f%%%s\n", name, o, n, delta, mark)
+		}
+	}
+	return regressions
+}
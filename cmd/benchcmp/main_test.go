@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const oldRun = `goos: linux
+goarch: amd64
+pkg: github.com/peytonrunyan/proglog/internal/log
+BenchmarkAppend/64B-8       	 1000000	       700 ns/op	  90.43 MB/s	      88 B/op	       2 allocs/op
+BenchmarkAppend/64B-8       	 1000000	       900 ns/op	  90.43 MB/s	      88 B/op	       2 allocs/op
+BenchmarkReadRandom/64B-8   	  500000	      3000 ns/op	  20.86 MB/s	     232 B/op	       4 allocs/op
+BenchmarkRemoved-8          	  500000	      3000 ns/op
+PASS
+`
+
+const newRun = `BenchmarkAppend/64B-8       	 1000000	       850 ns/op	  90.43 MB/s	      88 B/op	       2 allocs/op
+BenchmarkReadRandom/64B-8   	  500000	      3600 ns/op	  20.86 MB/s	     232 B/op	       4 allocs/op
+BenchmarkAdded-8            	  500000	      3000 ns/op
+`
+
+func TestParse(t *testing.T) {
+	results, err := parse(strings.NewReader(oldRun))
+	require.NoError(t, err)
+	require.Equal(t, map[string]float64{
+		"BenchmarkAppend/64B-8":     800, // averaged
+		"BenchmarkReadRandom/64B-8": 3000,
+		"BenchmarkRemoved-8":        3000,
+	}, results)
+}
+
+func TestCompare(t *testing.T) {
+	old, err := parse(strings.NewReader(oldRun))
+	require.NoError(t, err)
+	cur, err := parse(strings.NewReader(newRun))
+	require.NoError(t, err)
+
+	// append is 6.25% slower, random reads 20% slower
+	require.Equal(t, 1, compare(ioutil.Discard, old, cur, 10))
+	require.Equal(t, 2, compare(ioutil.Discard, old, cur, 5))
+	require.Equal(t, 0, compare(ioutil.Discard, old, cur, 25))
+
+	var out strings.Builder
+	compare(&out, old, cur, 10)
+	require.Contains(t, out.String(), "BenchmarkReadRandom/64B-8")
+	require.Contains(t, out.String(), "REGRESSION")
+	require.Contains(t, out.String(), "BenchmarkAdded-8")
+	require.Contains(t, out.String(), "BenchmarkRemoved-8")
+}
@@ -0,0 +1,231 @@
+// A command line client for a proglog server's HTTP API. Usage:
+//
+//	proglogctl [-addr http://localhost:8082] repl [-script file]
+//
+// repl reads commands one per line, from the terminal or from a script, and keeps a current
+// position between them:
+//
+//	offsets          show the lowest and highest offsets in the log
+//	get <offset>     show the record at offset and move the position past it
+//	next [n]         show the next n records (default 1) from the position
+//	tail [n]         show the last n records (default 10) and move the position past them
+//	produce <text>   append a record holding text
+//	help             list the commands
+//	quit             leave the repl
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/peytonrunyan/proglog/internal/server"
+)
+
+func main() {
+	addr := flag.String("addr", "http://localhost:8082", "address of the server's HTTP API")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: proglogctl [-addr url] repl [-script file]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 || flag.Arg(0) != "repl" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	replFlags := flag.NewFlagSet("repl", flag.ExitOnError)
+	script := replFlags.String("script", "", "run the commands in file instead of reading them from the terminal")
+	replFlags.Parse(flag.Args()[1:])
+
+	r := &repl{addr: strings.TrimSuffix(*addr, "/"), client: http.DefaultClient, out: os.Stdout}
+	in, prompt := io.Reader(os.Stdin), true
+	if *script != "" {
+		f, err := os.Open(*script)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		defer f.Close()
+		in, prompt = f, false
+	}
+	if err := r.run(in, prompt); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// An interactive session against a server. pos is where next reads from.
+type repl struct {
+	addr   string
+	client *http.Client
+	out    io.Writer
+	pos    uint64
+}
+
+// Runs each line of in as a command until in runs out or quit is given. A command that fails
+// prints its error and the session carries on, unless it's running a script, where the first
+// failure is returned so runbooks don't plough on regardless.
+func (r *repl) run(in io.Reader, prompt bool) error {
+	scanner := bufio.NewScanner(in)
+	for {
+		if prompt {
+			fmt.Fprint(r.out, "> ")
+		}
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "quit" || line == "exit" {
+			return nil
+		}
+		if err := r.exec(line); err != nil {
+			if !prompt {
+				return fmt.Errorf("%s: %w", line, err)
+			}
+			fmt.Fprintf(r.out, "error: %v\n", err)
+		}
+	}
+}
+
+// Runs a single command.
+func (r *repl) exec(line string) error {
+	cmd, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	switch cmd {
+	case "offsets":
+		offsets, err := r.offsets()
+		if err != nil {
+			return err
+		}
+		if offsets.Highest == nil {
+			fmt.Fprintf(r.out, "lowest %d, empty\n", offsets.Lowest)
+			return nil
+		}
+		fmt.Fprintf(r.out, "lowest %d, highest %d\n", offsets.Lowest, *offsets.Highest)
+		return nil
+	case "get":
+		off, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("usage: get <offset>")
+		}
+		r.pos = off
+		return r.next(1)
+	case "next":
+		n, err := count(arg, 1)
+		if err != nil {
+			return fmt.Errorf("usage: next [n]")
+		}
+		return r.next(n)
+	case "tail":
+		n, err := count(arg, 10)
+		if err != nil {
+			return fmt.Errorf("usage: tail [n]")
+		}
+		offsets, err := r.offsets()
+		if err != nil {
+			return err
+		}
+		if offsets.Highest == nil {
+			return nil
+		}
+		r.pos = offsets.Lowest
+		if *offsets.Highest+1-offsets.Lowest > n {
+			r.pos = *offsets.Highest + 1 - n
+		}
+		return r.next(*offsets.Highest + 1 - r.pos)
+	case "produce":
+		var resp server.ProduceResponse
+		req := server.ProduceRequest{Record: server.Record{Value: []byte(arg)}}
+		if err := r.call(http.MethodPost, "/", req, &resp); err != nil {
+			return err
+		}
+		fmt.Fprintf(r.out, "produced offset %d\n", resp.Offset)
+		return nil
+	case "help":
+		fmt.Fprintln(r.out, "commands: offsets, get <offset>, next [n], tail [n], produce <text>, quit")
+		return nil
+	case "use", "seek", "filter":
+		return fmt.Errorf("%s isn't supported: the log has no topics, timestamps or keys", cmd)
+	}
+	return fmt.Errorf("unknown command %q, try help", cmd)
+}
+
+// Prints n records from the position on, moving the position past each one. Stops quietly at
+// the end of the log.
+func (r *repl) next(n uint64) error {
+	for i := uint64(0); i < n; i++ {
+		var resp server.ConsumeResponse
+		err := r.call(http.MethodGet, "/", server.ConsumeRequest{Offset: r.pos}, &resp)
+		if err == errNotFound && i > 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(r.out, "%d\t%s\n", resp.Offset, resp.Value)
+		r.pos = resp.NextOffset
+	}
+	return nil
+}
+
+func (r *repl) offsets() (server.OffsetsResponse, error) {
+	var resp server.OffsetsResponse
+	err := r.call(http.MethodGet, "/offsets", nil, &resp)
+	return resp, err
+}
+
+var errNotFound = fmt.Errorf("no record at that offset")
+
+// Sends req as JSON to the path and decodes the response into resp.
+func (r *repl) call(method, path string, req, resp interface{}) error {
+	var body io.Reader
+	if req != nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	httpReq, err := http.NewRequest(method, r.addr+path, body)
+	if err != nil {
+		return err
+	}
+	httpResp, err := r.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(httpResp.Body)
+		return fmt.Errorf("%s: %s", httpResp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// Parses an optional positive count, returning def if arg is empty.
+func count(arg string, def uint64) (uint64, error) {
+	if arg == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid count %q", arg)
+	}
+	return n, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/peytonrunyan/proglog/internal/log"
+	"github.com/peytonrunyan/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+// Starts a server on a log in a temp dir and returns a repl talking to it.
+func setupRepl(t *testing.T) (*repl, *bytes.Buffer) {
+	dir, _ := ioutil.TempDir("", "proglogctl-test")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	srv, err := server.NewHTTPServer(":0", dir, log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	ts := httptest.NewServer(srv.Handler)
+	t.Cleanup(ts.Close)
+	out := &bytes.Buffer{}
+	return &repl{addr: ts.URL, client: ts.Client(), out: out}, out
+}
+
+func TestReplScript(t *testing.T) {
+	r, out := setupRepl(t)
+	script := `# fill the log
+offsets
+produce first
+produce second
+produce third
+offsets
+get 0
+next
+next 5
+tail 2
+quit
+produce never run
+`
+	require.NoError(t, r.run(strings.NewReader(script), false))
+	require.Equal(t, `lowest 0, empty
+produced offset 0
+produced offset 1
+produced offset 2
+lowest 0, highest 2
+0	first
+1	second
+2	third
+1	second
+2	third
+`, out.String())
+	require.Equal(t, uint64(3), r.pos)
+}
+
+func TestReplErrors(t *testing.T) {
+	r, out := setupRepl(t)
+
+	// interactive sessions report the error and carry on
+	require.NoError(t, r.run(strings.NewReader("get 5\nbogus\nuse orders\nproduce hi\n"), true))
+	require.Equal(t, `> error: no record at that offset
+> error: unknown command "bogus", try help
+> error: use isn't supported: the log has no topics, timestamps or keys
+> produced offset 0
+> `, out.String())
+
+	// scripts stop at the first failure
+	out.Reset()
+	err := r.run(strings.NewReader("get 0\nget x\nget 0\n"), false)
+	require.EqualError(t, err, "get x: usage: get <offset>")
+	require.Equal(t, "0\thi\n", out.String())
+}
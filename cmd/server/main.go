@@ -1,16 +1,47 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 
+	plog "github.com/peytonrunyan/proglog/internal/log"
 	"github.com/peytonrunyan/proglog/internal/server"
 )
 
 const port string = "8082"
 
 func main() {
-	srv := server.NewHTTPServer(":" + port)
+	dir := flag.String("data-dir", "data", "directory the log's segments are kept in")
+	check := flag.String("integrity-check", "quick", "how to check the data directory on startup: off, quick or full")
+	budget := flag.Duration("integrity-budget", 0, "how long the quick integrity check may take, 0 for no limit")
+	onCorruption := flag.String("on-corruption", "fail", "what to do when the check finds damage: fail or serve-degraded")
+	flag.Parse()
+
+	c := plog.Config{}
+	switch *check {
+	case "off":
+		c.Integrity.Check = plog.IntegrityOff
+	case "quick":
+		c.Integrity.Check = plog.IntegrityQuick
+	case "full":
+		c.Integrity.Check = plog.IntegrityFull
+	default:
+		log.Fatalf("unknown -integrity-check %q", *check)
+	}
+	c.Integrity.QuickBudget = *budget
+	switch *onCorruption {
+	case "fail":
+	case "serve-degraded":
+		c.Integrity.ServeDegraded = true
+	default:
+		log.Fatalf("unknown -on-corruption %q", *onCorruption)
+	}
+
+	srv, err := server.NewHTTPServer(":"+port, *dir, c)
+	if err != nil {
+		log.Fatal(err)
+	}
 	fmt.Printf("Server running on port %s...", port)
 	log.Fatal(srv.ListenAndServe())
 }
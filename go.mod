@@ -3,9 +3,11 @@ module github.com/peytonrunyan/proglog
 go 1.16
 
 require (
-	github.com/golang/protobuf v1.4.1
+	github.com/golang/protobuf v1.4.3
 	github.com/gorilla/mux v1.8.0
 	github.com/stretchr/testify v1.7.0
-	github.com/tysonmote/gommap v0.0.1 // indirect
+	github.com/tysonmote/gommap v0.0.1
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
+	google.golang.org/grpc v1.43.0
 	google.golang.org/protobuf v1.25.0
 )
@@ -0,0 +1,246 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	api "github.com/peytonrunyan/proglog/api/v1"
+)
+
+// Creates a log in a temp dir with segments big enough that rolling isn't what's being measured.
+func benchLog(b *testing.B) *Log {
+	dir, err := ioutil.TempDir("", "log-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { os.RemoveAll(dir) })
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64 << 20
+	c.Segment.MaxIndexBytes = 1 << 20 * entryWidth
+	l, err := NewLog(dir, c)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { l.Close() })
+	return l
+}
+
+// Fills the log with n records of the given size.
+func fillLog(b *testing.B, l *Log, n, size int) {
+	record := &api.Record{Value: make([]byte, size)}
+	for i := 0; i < n; i++ {
+		if _, err := l.Append(record); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var benchSizes = []int{64, 1024, 16 << 10}
+
+func BenchmarkAppend(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			l := benchLog(b)
+			record := &api.Record{Value: make([]byte, size)}
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := l.Append(record); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReadRandom(b *testing.B) {
+	const records = 10000
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			l := benchLog(b)
+			fillLog(b, l, records, size)
+			r := rand.New(rand.NewSource(1))
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := l.Read(uint64(r.Intn(records))); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReadSequential(b *testing.B) {
+	const records = 10000
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			l := benchLog(b)
+			fillLog(b, l, records, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := l.Read(uint64(i % records)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAppendBatch(b *testing.B) {
+	const batchSize = 100
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			l := benchLog(b)
+			batch := make([]*api.Record, batchSize)
+			for i := range batch {
+				batch[i] = &api.Record{Value: make([]byte, size)}
+			}
+			b.SetBytes(int64(size * batchSize))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := l.AppendBatch(batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Readers hammering records that were flushed long ago while a writer keeps appending, to see
+// how much the readers contend with the writer and with each other.
+func BenchmarkStoreReadWhileAppending(b *testing.B) {
+	f, err := ioutil.TempFile("", "store-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	s, err := newStore(f, Config{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	const records = 1000
+	data := make([]byte, 256)
+	positions := make([]uint64, records)
+	for i := range positions {
+		if _, positions[i], err = s.Append(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if _, err = s.Read(positions[0]); err != nil { // flush
+		b.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				if _, _, err := s.Append(data); err != nil {
+					panic(err)
+				}
+			}
+		}
+	}()
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(1))
+		for pb.Next() {
+			if _, err := s.Read(positions[r.Intn(records)]); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// Appends straight to a store with bufio's default buffer and with bigger ones.
+func BenchmarkStoreAppendBufferSize(b *testing.B) {
+	for _, bufSize := range []uint64{4 << 10, 64 << 10, 1 << 20} {
+		for _, size := range benchSizes {
+			b.Run(fmt.Sprintf("%dKB/%dB", bufSize>>10, size), func(b *testing.B) {
+				f, err := ioutil.TempFile("", "store-bench")
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer os.Remove(f.Name())
+				c := Config{}
+				c.Store.WriteBufferSize = bufSize
+				s, err := newStore(f, c)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer s.Close()
+				data := make([]byte, size)
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, _, err := s.Append(data); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// Writers appending 100 small records at a time to a shared store, one Append per record versus
+// one AppendBatch for the lot, to see what taking the mutex once per batch saves.
+func BenchmarkStoreAppendBatch(b *testing.B) {
+	const batchSize = 100
+	batch := make([][]byte, batchSize)
+	for i := range batch {
+		batch[i] = make([]byte, 64)
+	}
+	for _, name := range []string{"loop", "batch"} {
+		b.Run(name, func(b *testing.B) {
+			f, err := ioutil.TempFile("", "store-bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			s, err := newStore(f, Config{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+			b.SetBytes(64 * batchSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if name == "batch" {
+						if _, _, err := s.AppendBatch(batch); err != nil {
+							b.Error(err)
+							return
+						}
+						continue
+					}
+					for _, data := range batch {
+						if _, _, err := s.Append(data); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}
+			})
+		})
+	}
+}
@@ -1,10 +1,58 @@
 package log
 
-// Used to centralize the log's configuration
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Used to centralize the log's configuration. MaxStoreBytes and MaxIndexBytes limit the
+// records and entries in a segment's files; the small header at the start of each file is not
+// counted against them. With IndexGrowBytes set, MaxIndexBytes is only how big an index starts
+// out: a full index grows by IndexGrowBytes at a time, and segments roll when their store fills.
+//
+// Retention limits how much of the log Log.EnforceRetention keeps, zero values mean no limit.
+// With a CheckInterval the log enforces it in the background by itself.
+//
+// Read.OnUndecodable says what Log.Read does with a record whose stored bytes can't be decoded.
+//
+// Integrity says how NewLog checks the directory before opening the log. If it finds damage
+// NewLog fails with an IntegrityError, unless ServeDegraded is set, in which case it leaves out
+// segments it can't open and returns a read-only log that lists the damage.
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		ByteOrder     binary.ByteOrder // used for new store and index files, defaults to big endian
+		MmapFallback  bool             // if mmap fails, read and write the index file directly instead of erroring
+
+		IndexGrowBytes uint64 // how much a full index grows by, e.g. MaxIndexBytes, 0 to roll the segment instead
+	}
+	Store struct {
+		WriteBufferSize uint64 // bytes appended records are buffered in before being written, 0 for bufio's default
+	}
+	Retention struct {
+		MaxBytes uint64        // total size of the segments' stores
+		MaxAge   time.Duration // how long since a segment's store was last written to
+
+		CheckInterval time.Duration // how often to enforce retention in the background, 0 to leave it to the caller
+	}
+	Read struct {
+		OnUndecodable DecodePolicy
+	}
+	Integrity struct {
+		Check         IntegrityCheck
+		QuickBudget   time.Duration // how long the quick part of the check may take, 0 for no limit
+		ServeDegraded bool
 	}
 }
+
+// What Log.Read does with a record that's corrupted (see ErrChecksumMismatch) or can't be
+// unmarshalled, e.g. because it was written with an incompatible schema.
+type DecodePolicy int
+
+const (
+	DecodeFail DecodePolicy = iota // return an ErrUndecodable, the default
+	DecodeSkip                     // return the next record that can be decoded instead
+	DecodeRaw                      // return the stored bytes as the record's value, with Undecodable set
+)
@@ -0,0 +1,175 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// Every new store and index file begins with a small header recording how the file was
+// written, so that it can be read back correctly no matter how the reading process is
+// configured. The header is headerWidth bytes long:
+//
+//	magic (4 bytes) | version (1 byte) | byte order (1 byte) | framing (1 byte) | reserved (1 byte)
+//
+// Files written before headers existed start directly with a record length (store) or an
+// index entry offset (index). The high bytes of those are zero in practice, so they never
+// match the magic, and such files are read as big endian with fixed framing. A file that is
+// shorter than a header but starts like one was cut off while its header was being written,
+// and is treated as corrupt rather than legacy.
+//
+// Only the byte order is configurable for now. New files are written with checksummed framing,
+// where each record's length is followed by a CRC32-C of its payload. Files written with fixed
+// framing, including legacy files, are still read and appended to in fixed framing.
+const (
+	headerWidth   uint64 = 8
+	headerVersion byte   = 1
+
+	orderBigEndian    byte = 0
+	orderLittleEndian byte = 1
+
+	framingFixed    byte = 0 // each record is prefixed with its length as a lenWidth byte uint64
+	framingChecksum byte = 1 // as framingFixed, with a crcWidth byte CRC32-C of the payload after the length
+)
+
+var (
+	magic = []byte("plog")
+
+	// used for files that were written before headers existed
+	legacyHeader = header{enc: binary.BigEndian, framing: framingFixed}
+
+	ErrUnsupportedByteOrder = fmt.Errorf("unsupported byte order")
+	ErrUnsupportedHeader    = fmt.Errorf("unsupported file header")
+	ErrTruncatedHeader      = fmt.Errorf("file header is incomplete")
+)
+
+// Describes how a store or index file is encoded. A zero version means the file is a legacy,
+// headerless file.
+type header struct {
+	version byte
+	enc     binary.ByteOrder
+	framing byte
+}
+
+// Builds the header for a new file from the config. The byte order defaults to big endian.
+func newHeader(c Config) (header, error) {
+	h := header{version: headerVersion, enc: binary.BigEndian, framing: framingChecksum}
+	switch c.Segment.ByteOrder {
+	case nil, binary.BigEndian:
+	case binary.LittleEndian:
+		h.enc = binary.LittleEndian
+	default:
+		return header{}, ErrUnsupportedByteOrder
+	}
+	return h, nil
+}
+
+// Reads the header at the start of a non-empty file of the given size. Files that don't begin
+// with the magic are treated as legacy files.
+func readHeader(f *os.File, size uint64) (header, error) {
+	b := make([]byte, headerWidth)
+	if size < headerWidth {
+		b = b[:size]
+	}
+	if _, err := f.ReadAt(b, 0); err != nil {
+		return header{}, err
+	}
+	n := len(magic)
+	if len(b) < n {
+		n = len(b)
+	}
+	if !bytes.Equal(b[:n], magic[:n]) {
+		return legacyHeader, nil
+	}
+	if size < headerWidth {
+		return header{}, ErrTruncatedHeader
+	}
+	return parseHeader(b)
+}
+
+// Decodes a header that is known to start with the magic.
+func parseHeader(b []byte) (header, error) {
+	h := header{version: b[4], framing: b[6]}
+	if h.version != headerVersion || (h.framing != framingFixed && h.framing != framingChecksum) {
+		return header{}, ErrUnsupportedHeader
+	}
+	switch b[5] {
+	case orderBigEndian:
+		h.enc = binary.BigEndian
+	case orderLittleEndian:
+		h.enc = binary.LittleEndian
+	default:
+		return header{}, ErrUnsupportedHeader
+	}
+	return h, nil
+}
+
+// Returns the on-disk representation of the header.
+func (h header) encode() []byte {
+	b := make([]byte, headerWidth)
+	copy(b, magic)
+	b[4] = h.version
+	if h.enc == binary.LittleEndian {
+		b[5] = orderLittleEndian
+	}
+	b[6] = h.framing
+	return b
+}
+
+// Returns the number of bytes the header takes up at the start of the file.
+func (h header) width() uint64 {
+	if h.version == 0 {
+		return 0
+	}
+	return headerWidth
+}
+
+// Returns the number of bytes in front of each record's payload in a store written with the
+// header's framing.
+func (h header) prefixWidth() uint64 {
+	if h.framing == framingChecksum {
+		return lenWidth + crcWidth
+	}
+	return lenWidth
+}
+
+// Describes how an existing store file is encoded, for tooling that needs to decide how to
+// read a file without opening it as part of a segment.
+type StoreInfo struct {
+	Version     byte             // header version, 0 for legacy files without a header
+	ByteOrder   binary.ByteOrder // byte order of record lengths
+	Framing     string           // how records are delimited, "fixed" is the only framing so far
+	Checksum    string           // per-record checksum algorithm, "crc32c" or "none"
+	Compression string           // per-record compression codec, "none" until compression exists
+}
+
+// Reads the header of the store file at path and reports how the file is encoded.
+func ReadStoreInfo(path string) (StoreInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return StoreInfo{}, err
+	}
+	defer f.Close()
+	fStat, err := f.Stat()
+	if err != nil {
+		return StoreInfo{}, err
+	}
+	h := legacyHeader
+	if fStat.Size() > 0 {
+		if h, err = readHeader(f, uint64(fStat.Size())); err != nil {
+			return StoreInfo{}, err
+		}
+	}
+	info := StoreInfo{
+		Version:     h.version,
+		ByteOrder:   h.enc,
+		Framing:     "fixed",
+		Checksum:    "none",
+		Compression: "none",
+	}
+	if h.framing == framingChecksum {
+		info.Checksum = "crc32c"
+	}
+	return info, nil
+}
@@ -0,0 +1,188 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	api "github.com/peytonrunyan/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// Legacy (headerless, big endian) and headered little endian segments should be readable side
+// by side, regardless of the byte order the reading process is configured with.
+func TestHeaderLegacyAndHeaderedSegments(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "header-test")
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("hello world")}
+	writeLegacySegment(t, dir, 0, want, 3)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.ByteOrder = binary.LittleEndian
+
+	legacy, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), legacy.nextOffset)
+	require.Equal(t, binary.BigEndian, legacy.store.enc)
+	require.Equal(t, binary.BigEndian, legacy.index.header.enc)
+	// legacy segments keep being written in the legacy format
+	off, err := legacy.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	headered, err := newSegment(dir, 4, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = headered.Append(want)
+		require.NoError(t, err)
+	}
+	require.NoError(t, legacy.Close())
+	require.NoError(t, headered.Close())
+
+	for _, name := range []string{"4.store", "4.index"} {
+		b, err := ioutil.ReadFile(path.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, magic, b[:len(magic)])
+		require.Equal(t, orderLittleEndian, b[5])
+	}
+	b, err := ioutil.ReadFile(path.Join(dir, "0.store"))
+	require.NoError(t, err)
+	require.NotEqual(t, magic, b[:len(magic)])
+
+	// reopen with the default (big endian) config; each file's own encoding should win
+	c.Segment.ByteOrder = nil
+	for base, count := range map[uint64]uint64{0: 4, 4: 3} {
+		s, err := newSegment(dir, base, c)
+		require.NoError(t, err)
+		require.Equal(t, base+count, s.nextOffset)
+		for off := base; off < base+count; off++ {
+			got, err := s.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, want.Value, got.Value)
+			require.Equal(t, off, got.Offset)
+		}
+		require.NoError(t, s.Close())
+	}
+}
+
+func TestHeaderUnsupportedByteOrder(t *testing.T) {
+	c := Config{}
+	c.Segment.ByteOrder = nativeOrder{}
+	_, err := newHeader(c)
+	require.Equal(t, ErrUnsupportedByteOrder, err)
+}
+
+// Writes a segment the way the store and index did before headers existed.
+func writeLegacySegment(t *testing.T, dir string, baseOffset uint64, record *api.Record, n int) {
+	t.Helper()
+	var store, index bytes.Buffer
+	for i := 0; i < n; i++ {
+		record.Offset = baseOffset + uint64(i)
+		p, err := proto.Marshal(record)
+		require.NoError(t, err)
+		require.NoError(t, binary.Write(&index, binary.BigEndian, uint32(i)))
+		require.NoError(t, binary.Write(&index, binary.BigEndian, uint64(store.Len())))
+		require.NoError(t, binary.Write(&store, binary.BigEndian, uint64(len(p))))
+		store.Write(p)
+	}
+	err := ioutil.WriteFile(path.Join(dir, fmt.Sprintf("%d.store", baseOffset)), store.Bytes(), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(path.Join(dir, fmt.Sprintf("%d.index", baseOffset)), index.Bytes(), 0644)
+	require.NoError(t, err)
+}
+
+// A byte order that isn't one of the two supported by the header.
+type nativeOrder struct{ binary.ByteOrder }
+
+// A file cut off partway through its header must not be mistaken for a legacy file.
+func TestHeaderTruncated(t *testing.T) {
+	for _, contents := range [][]byte{[]byte("pl"), append([]byte("plog"), headerVersion)} {
+		f, err := ioutil.TempFile("", "header_truncated_test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		_, err = f.Write(contents)
+		require.NoError(t, err)
+
+		_, err = newStore(f, Config{})
+		require.Equal(t, ErrTruncatedHeader, err)
+	}
+
+	// short legacy files don't start with the magic, so they're still legacy
+	f, err := ioutil.TempFile("", "header_short_legacy_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte{0, 0, 0})
+	require.NoError(t, err)
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), s.start)
+}
+
+// Headers don't count towards MaxIndexBytes, so an index sized for n entries holds n entries.
+func TestHeaderExcludedFromLimits(t *testing.T) {
+	f, err := ioutil.TempFile("", "header_limits_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	for i := uint32(0); i < 3; i++ {
+		require.NoError(t, idx.Write(i, uint64(i)))
+	}
+	require.Equal(t, io.EOF, idx.Write(3, 3))
+	require.NoError(t, idx.Close())
+}
+
+func TestReadStoreInfo(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "store-info-test")
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("hello world")}
+	writeLegacySegment(t, dir, 0, want, 1)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	for base, order := range map[uint64]binary.ByteOrder{1: binary.BigEndian, 2: binary.LittleEndian} {
+		c.Segment.ByteOrder = order
+		s, err := newSegment(dir, base, c)
+		require.NoError(t, err)
+		_, err = s.Append(want)
+		require.NoError(t, err)
+		require.NoError(t, s.Close())
+	}
+
+	tests := []struct {
+		name     string
+		version  byte
+		order    binary.ByteOrder
+		checksum string
+	}{
+		{name: "0.store", version: 0, order: binary.BigEndian, checksum: "none"},
+		{name: "1.store", version: headerVersion, order: binary.BigEndian, checksum: "crc32c"},
+		{name: "2.store", version: headerVersion, order: binary.LittleEndian, checksum: "crc32c"},
+	}
+	for _, tc := range tests {
+		info, err := ReadStoreInfo(path.Join(dir, tc.name))
+		require.NoError(t, err)
+		require.Equal(t, tc.version, info.Version, tc.name)
+		require.Equal(t, tc.order, info.ByteOrder, tc.name)
+		require.Equal(t, "fixed", info.Framing, tc.name)
+		require.Equal(t, tc.checksum, info.Checksum, tc.name)
+		require.Equal(t, "none", info.Compression, tc.name)
+	}
+
+	_, err := ReadStoreInfo(path.Join(dir, "missing.store"))
+	require.True(t, os.IsNotExist(err))
+}
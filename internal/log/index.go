@@ -2,6 +2,7 @@ package log
 
 import (
 	"io"
+	stdlog "log"
 	"os"
 
 	"github.com/tysonmote/gommap"
@@ -14,52 +15,166 @@ var (
 	// The length of each record in our index. We can jump to a given record in the
 	// index by going to byte entryWidth*offset, e.g. the fourth record is at entryWidth*4
 	entryWidth = offWidth + posWidth
+
+	// Memory maps index files. It's a variable so tests can simulate systems where mmap is
+	// restricted.
+	mapIndex = func(f *os.File) (gommap.MMap, error) {
+		return gommap.Map(
+			f.Fd(),
+			gommap.PROT_READ|gommap.PROT_WRITE,
+			gommap.MAP_SHARED, // let forked processes access the mmap
+		)
+	}
 )
 
 // Struct for our index. Holds a persistent index file and a memory mapped file
 // Size is the size of the index file and tells us where our next entry should be appended
 type index struct {
-	file *os.File    // index file
-	mmap gommap.MMap // memory mapped index file
-	size uint64      // size of the index file - where our next entry should be appended
+	file   *os.File    // index file
+	mmap   gommap.MMap // memory mapped index file
+	size   uint64      // size of the index file - where our next entry should be appended
+	header header      // how the file is encoded; entries begin after the header
+	mapped bool        // false if mmap failed and the index fell back to reading and writing the file
+	growBy uint64      // bytes to grow the file by when it's full, 0 if it doesn't grow
 }
 
 // Creates an index for the given file. The file's size is truncated to the
-// max length specified in the config (truncate will grow it to that size if it is
-// shorter than the specified length) and then the file is memory mapped before the
+// max length specified in the config plus the header (truncate will grow it to that size if
+// it is shorter than the specified length) and then the file is memory mapped before the
 // index is returned.
 //
+// New files get a header describing how they're encoded, existing files are read using the
+// encoding recorded in their header.
+//
+// If the file can't be memory mapped and Config.Segment.MmapFallback is set, a warning is
+// logged and the index falls back to a copy of the file held in memory, with each entry
+// written through to the file as it's appended.
+//
 // Details: We truncate the file to max size because we cannot change the size of a file
-// that has been memory mapped
+// that has been memory mapped. If Config.Segment.IndexGrowBytes is set, a full index is grown
+// by truncating the file to a larger size and mapping it again, see grow. An index that has
+// grown past MaxIndexBytes is mapped at its size on disk when it's reopened, whether or not it
+// may grow any further, so the file is never shrunk out from under its entries.
 func newIndex(f *os.File, c Config) (*index, error) {
-	idx := &index{file: f}
+	idx := &index{file: f, growBy: c.Segment.IndexGrowBytes}
 
 	fStat, err := os.Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
-	idx.size = uint64(fStat.Size())                             // where to resume
-	err = os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)) // max size of file
+	idx.size = uint64(fStat.Size()) // where to resume
+	isNew := idx.size == 0
+	if isNew {
+		idx.header, err = newHeader(c)
+	} else {
+		idx.header, err = readHeader(f, idx.size)
+	}
 	if err != nil {
 		return nil, err
 	}
-	if idx.mmap, err = gommap.Map( // memory map the file
-		idx.file.Fd(),
-		gommap.PROT_READ|gommap.PROT_WRITE,
-		gommap.MAP_SHARED, // let forked processes access the mmap
-	); err != nil {
+	// max size of file, the header doesn't count towards the limit
+	mapSize := idx.header.width() + c.Segment.MaxIndexBytes
+	if idx.size > mapSize {
+		mapSize = idx.size
+	}
+	err = os.Truncate(f.Name(), int64(mapSize))
+	if err != nil {
 		return nil, err
 	}
+	idx.mapped = true
+	if idx.mmap, err = mapIndex(idx.file); err != nil { // memory map the file
+		if !c.Segment.MmapFallback {
+			// put the file back the way we found it so it isn't mistaken for a full index
+			if tErr := f.Truncate(int64(idx.size)); tErr != nil {
+				return nil, tErr
+			}
+			return nil, err
+		}
+		stdlog.Printf("log: can't mmap index %s, falling back to file reads and writes: %v", f.Name(), err)
+		if err = idx.loadFile(); err != nil {
+			return nil, err
+		}
+	}
+	if isNew {
+		idx.size = uint64(copy(idx.mmap, idx.header.encode()))
+		if err = idx.writeThrough(0, idx.size); err != nil {
+			return nil, err
+		}
+	} else {
+		idx.sanitize()
+	}
 	return idx, nil
 }
 
+// Finds where the entries really end in an existing index. An index that wasn't closed cleanly
+// is still at its max size, so the size taken from the file takes in the zero-filled space
+// after the last entry. Entries are read from the front, and the size is set to the end of the
+// last one that follows on from those before it: entry k holds relative offset k, and points
+// further into the store than entry k-1. A zeroed slot fails both after the first entry.
+//
+// The first entry can't be told apart from zeroed space, since offset 0 at store position 0 is
+// valid for stores without a header, so it's kept if it's there. The segment drops it, along with
+// any other entry pointing past the end of its store, when it's opened.
+func (idx *index) sanitize() {
+	hdr := idx.header.width()
+	end := hdr
+	var prevPos uint64
+	for end+entryWidth <= uint64(len(idx.mmap)) {
+		relOffset := idx.header.enc.Uint32(idx.mmap[end : end+offWidth])
+		pos := idx.header.enc.Uint64(idx.mmap[end+offWidth : end+entryWidth])
+		k := (end - hdr) / entryWidth
+		if uint64(relOffset) != k || k > 0 && pos <= prevPos {
+			break
+		}
+		prevPos = pos
+		end += entryWidth
+	}
+	idx.size = end
+}
+
+// Reads the whole index file into memory in place of the memory map. Used when mmap fails.
+func (idx *index) loadFile() error {
+	fStat, err := idx.file.Stat()
+	if err != nil {
+		return err
+	}
+	idx.mmap = make(gommap.MMap, fStat.Size())
+	if _, err = idx.file.ReadAt(idx.mmap, 0); err != nil && err != io.EOF {
+		return err
+	}
+	idx.mapped = false
+	return nil
+}
+
+// Writes the bytes in [start, end) through to the index file. A no-op when the file is
+// memory mapped, since the OS persists the map for us.
+func (idx *index) writeThrough(start, end uint64) error {
+	if idx.mapped {
+		return nil
+	}
+	_, err := idx.file.WriteAt(idx.mmap[start:end], int64(start))
+	return err
+}
+
+// Persists the entries written so far to stable storage.
+func (idx *index) Sync() error {
+	if idx.mapped {
+		if err := idx.mmap.Sync(gommap.MS_SYNC); err != nil {
+			return err
+		}
+	}
+	return idx.file.Sync()
+}
+
 // Closes the file and persists the data to storage. It will also resize the file
 // from the max file size to the size of the written contents to ensure that reads and
 // writes begin from the correct location.
 func (idx *index) Close() error {
-	// sync memory-mapped file to persisted file
-	if err := idx.mmap.Sync(gommap.MS_SYNC); err != nil {
-		return err
+	// sync memory-mapped file to persisted file, the fallback has already written its entries
+	if idx.mapped {
+		if err := idx.mmap.Sync(gommap.MS_SYNC); err != nil {
+			return err
+		}
 	}
 	// ensure that everything is written to stable storage
 	if err := idx.file.Sync(); err != nil {
@@ -75,23 +190,25 @@ func (idx *index) Close() error {
 // Get the store position for an entry at a given offset in our index. Use -1 to get the last
 // entry. Returns the offset that was used, the entry's position in the store, and err.
 func (idx *index) Read(offsetGiven int64) (offsetUsed uint32, storePosition uint64, err error) {
-	if idx.size == 0 {
+	hdr := idx.header.width()
+	if idx.size <= hdr {
 		return 0, 0, io.EOF
 	}
 	if offsetGiven == -1 { // position of the last entry
-		offsetUsed = (uint32(idx.size) / uint32(entryWidth)) - 1
+		offsetUsed = (uint32(idx.size-hdr) / uint32(entryWidth)) - 1
 	} else {
 		offsetUsed = uint32(offsetGiven) // 0 indexed, so offset*entryWidth = start of entry
 	}
+	// entries are laid out back to back after the header
+	entryStart := hdr + uint64(offsetUsed)*entryWidth
 	// make sure we've actually got 12 bytes to read
-	if (uint64(offsetUsed)*entryWidth)+entryWidth > idx.size {
+	if entryStart+entryWidth > idx.size {
 		return 0, 0, io.EOF
 	}
-	entryStart := uint64(offsetUsed) * entryWidth
 	// set offset to actual listed offset at entry location
-	offsetUsed = enc.Uint32(idx.mmap[entryStart : entryStart+offWidth])
+	offsetUsed = idx.header.enc.Uint32(idx.mmap[entryStart : entryStart+offWidth])
 	// get last 8 bits of the entry
-	storePosition = enc.Uint64(idx.mmap[entryStart+offWidth : entryStart+entryWidth])
+	storePosition = idx.header.enc.Uint64(idx.mmap[entryStart+offWidth : entryStart+entryWidth])
 	return offsetUsed, storePosition, nil
 }
 
@@ -99,14 +216,54 @@ func (idx *index) Read(offsetGiven int64) (offsetUsed uint32, storePosition uint
 // record is located in the store. Returns err.
 func (idx *index) Write(offset uint32, storePosition uint64) error {
 	if uint64(len(idx.mmap)) < (uint64(idx.size) + entryWidth) { // check for room
-		return io.EOF
+		if idx.growBy == 0 {
+			return io.EOF
+		}
+		if err := idx.grow(); err != nil {
+			return err
+		}
+	}
+	idx.header.enc.PutUint32(idx.mmap[idx.size:idx.size+offWidth], offset)
+	idx.header.enc.PutUint64(idx.mmap[idx.size+offWidth:idx.size+entryWidth], storePosition)
+	if err := idx.writeThrough(idx.size, idx.size+entryWidth); err != nil {
+		return err
 	}
-	enc.PutUint32(idx.mmap[idx.size:idx.size+offWidth], offset)
-	enc.PutUint64(idx.mmap[idx.size+offWidth:idx.size+entryWidth], storePosition)
 	idx.size += uint64(entryWidth)
 	return nil
 }
 
+// Makes room for more entries by growing the file by growBy bytes. A memory mapped file is
+// mapped again at its new size before the old map is released, so if mapping fails the index
+// carries on with the room it had and the next Write tries again. Close truncates the file back
+// down to the entries written, as it does when the index hasn't grown.
+func (idx *index) grow() error {
+	size := uint64(len(idx.mmap)) + idx.growBy
+	if err := idx.file.Truncate(int64(size)); err != nil {
+		return err
+	}
+	if !idx.mapped {
+		grown := make(gommap.MMap, size)
+		copy(grown, idx.mmap)
+		idx.mmap = grown
+		return nil
+	}
+	grown, err := mapIndex(idx.file)
+	if err != nil {
+		return err
+	}
+	if err = idx.mmap.UnsafeUnmap(); err != nil {
+		grown.UnsafeUnmap()
+		return err
+	}
+	idx.mmap = grown
+	return nil
+}
+
+// Returns the byte offset in the index file where the next entry will be written.
+func (idx *index) NextEntryOffset() uint64 {
+	return idx.size
+}
+
 // Return the filename of our index's persistent file.
 func (idx *index) Name() string {
 	return idx.file.Name()
@@ -4,9 +4,11 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"github.com/tysonmote/gommap"
 )
 
 func TestIndex(t *testing.T) {
@@ -31,7 +33,8 @@ func TestIndex(t *testing.T) {
 	}
 
 	// make sure entries are where we put them
-	for _, want := range entries {
+	for i, want := range entries {
+		require.Equal(t, headerWidth+uint64(i)*entryWidth, idx.NextEntryOffset())
 		err = idx.Write(want.Off, want.Pos)
 		require.NoError(t, err)
 		_, pos, err := idx.Read(int64(want.Off))
@@ -52,6 +55,182 @@ func TestIndex(t *testing.T) {
 	off, pos, err := idx.Read(-1)
 	require.NoError(t, err)
 	require.Equal(t, off, uint32(1))
-	require.Equal(t, pos, entries[1])
+	require.Equal(t, pos, entries[1].Pos)
 
 }
+
+func TestIndexMmapFallback(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_fallback_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// simulate a system where mmap is restricted
+	mapped := mapIndex
+	defer func() { mapIndex = mapped }()
+	mapIndex = func(*os.File) (gommap.MMap, error) {
+		return nil, syscall.EPERM
+	}
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	_, err = newIndex(f, c)
+	require.Equal(t, syscall.EPERM, err)
+	fStat, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), fStat.Size()) // not left looking like a full index
+
+	c.Segment.MmapFallback = true
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	require.False(t, idx.mapped)
+
+	for i := uint32(0); i < 3; i++ {
+		require.NoError(t, idx.Write(i, uint64(i)*10))
+		off, pos, err := idx.Read(int64(i))
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+		require.Equal(t, uint64(i)*10, pos)
+	}
+	require.NoError(t, idx.Close())
+
+	// entries were written to the file, so they're there when it's reopened with mmap working
+	mapIndex = mapped
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	require.True(t, idx.mapped)
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), off)
+	require.Equal(t, uint64(20), pos)
+	require.NoError(t, idx.Close())
+}
+
+// Every entry's offset and position should be read back from its own slot, not just the first's
+func TestIndexReadEntries(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_read_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	defer idx.Close()
+
+	entries := []struct {
+		Off uint32
+		Pos uint64
+	}{
+		{Off: 0, Pos: 8},
+		{Off: 1, Pos: 31},
+		{Off: 2, Pos: 77},
+	}
+	for _, e := range entries {
+		require.NoError(t, idx.Write(e.Off, e.Pos))
+	}
+	for i, want := range entries {
+		off, pos, err := idx.Read(int64(i))
+		require.NoError(t, err)
+		require.Equal(t, want.Off, off)
+		require.Equal(t, want.Pos, pos)
+	}
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, entries[2].Off, off)
+	require.Equal(t, entries[2].Pos, pos)
+}
+
+// An index that's never closed is left at its max size, zero-filled after the last entry
+func TestIndexSanitize(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_sanitize_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	for i := uint32(0); i < 3; i++ {
+		require.NoError(t, idx.Write(i, uint64(i)*10))
+	}
+	require.NoError(t, idx.Sync())
+
+	// crash: skip Close and map the same file again
+	fStat, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(headerWidth+c.Segment.MaxIndexBytes), fStat.Size())
+	f2, err := os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	recovered, err := newIndex(f2, c)
+	require.NoError(t, err)
+	defer recovered.Close()
+	require.Equal(t, headerWidth+3*entryWidth, recovered.NextEntryOffset())
+	off, pos, err := recovered.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), off)
+	require.Equal(t, uint64(20), pos)
+
+	// appends carry on from the last real entry
+	require.NoError(t, recovered.Write(3, 30))
+	off, pos, err = recovered.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), off)
+	require.Equal(t, uint64(30), pos)
+}
+
+// A full index that's allowed to grow takes more entries than MaxIndexBytes, mapped or not
+func TestIndexGrow(t *testing.T) {
+	mapped := mapIndex
+	defer func() { mapIndex = mapped }()
+	for _, useMmap := range []bool{true, false} {
+		f, err := ioutil.TempFile(os.TempDir(), "index_grow_test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+
+		mapIndex = mapped
+		if !useMmap {
+			mapIndex = func(*os.File) (gommap.MMap, error) {
+				return nil, syscall.EPERM
+			}
+		}
+		c := Config{}
+		c.Segment.MaxIndexBytes = entryWidth * 2
+		c.Segment.IndexGrowBytes = entryWidth * 3
+		c.Segment.MmapFallback = true
+		idx, err := newIndex(f, c)
+		require.NoError(t, err)
+		require.Equal(t, useMmap, idx.mapped)
+
+		const entries = 10
+		for i := uint32(0); i < entries; i++ {
+			require.NoError(t, idx.Write(i, uint64(i)*10))
+		}
+		// grown from 2 entries to 5, 8 and then 11
+		require.Equal(t, headerWidth+entryWidth*11, uint64(len(idx.mmap)))
+		for i := uint32(0); i < entries; i++ {
+			off, pos, err := idx.Read(int64(i))
+			require.NoError(t, err)
+			require.Equal(t, i, off)
+			require.Equal(t, uint64(i)*10, pos)
+		}
+
+		// Close truncates down to what was written, and all of it is there on reopening
+		require.NoError(t, idx.Close())
+		fStat, err := os.Stat(f.Name())
+		require.NoError(t, err)
+		require.Equal(t, int64(headerWidth+entryWidth*entries), fStat.Size())
+		f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+		require.NoError(t, err)
+		idx, err = newIndex(f, c)
+		require.NoError(t, err)
+		require.Equal(t, headerWidth+entryWidth*entries, idx.NextEntryOffset())
+		off, pos, err := idx.Read(-1)
+		require.NoError(t, err)
+		require.Equal(t, uint32(entries-1), off)
+		require.Equal(t, uint64(entries-1)*10, pos)
+		require.NoError(t, idx.Write(entries, entries*10))
+		require.NoError(t, idx.Close())
+	}
+}
@@ -0,0 +1,218 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How thoroughly NewLog checks the log's directory before handing back the log, see
+// Config.Integrity. Torn tails left by a crash are recovered when segments are opened whatever
+// the level.
+type IntegrityCheck int
+
+const (
+	IntegrityOff   IntegrityCheck = iota // open the segments and hope for the best
+	IntegrityQuick                       // every store has an index, and both have readable headers
+	IntegrityFull                        // quick, then every closed segment's index is verified against its store
+)
+
+// How often, in segments, the integrity check logs how far it's got.
+const integrityProgressEvery = 100
+
+// Returned by appends to a degraded log: one whose integrity check found damage when it was
+// opened, or whose active store was left dirty by a failed append. The log can still be read.
+var ErrDegraded = fmt.Errorf("log is read-only, it has damage")
+
+// A problem the integrity check found with the segment at BaseOffset.
+type Damage struct {
+	BaseOffset uint64
+	Err        error
+}
+
+func (d Damage) Error() string {
+	return fmt.Sprintf("segment %d: %v", d.BaseOffset, d.Err)
+}
+
+// Returned by NewLog when the integrity check finds damage and the log isn't configured to be
+// served degraded.
+type IntegrityError struct {
+	Damage []Damage
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity check found %d problems, the first: %v", len(e.Damage), e.Damage[0])
+}
+
+// The quick check. Makes sure every store has an index and every index has a store, and that
+// every file's header can be read. Returns what it found, stopping early with a log message if
+// ctx is done first, in which case the segments it didn't get to are opened unchecked.
+//
+// A store with no records and no index isn't damage: it's what a crash while a segment was being
+// created leaves behind, and opening the segment creates its index.
+func (l *Log) checkFiles(ctx context.Context, baseOffsets []uint64) ([]Damage, error) {
+	files, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
+	stores := make(map[uint64]bool, len(baseOffsets))
+	for _, off := range baseOffsets {
+		stores[off] = true
+	}
+	var damage []Damage
+	for _, file := range files {
+		if path.Ext(file.Name()) != ".index" {
+			continue
+		}
+		off, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ".index"), 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected index file %s: %w", file.Name(), err)
+		}
+		if !stores[off] {
+			damage = append(damage, Damage{BaseOffset: off, Err: fmt.Errorf("index has no store")})
+		}
+	}
+	for i, off := range baseOffsets {
+		if deadline, ok := ctx.Deadline(); ctx.Err() != nil || ok && !time.Now().Before(deadline) {
+			stdlog.Printf("log: integrity check of %s ran out of time after %d of %d segments", l.Dir, i, len(baseOffsets))
+			break
+		}
+		if i > 0 && i%integrityProgressEvery == 0 {
+			stdlog.Printf("log: integrity check of %s: %d of %d segments", l.Dir, i, len(baseOffsets))
+		}
+		if l.isUnindexedEmptyStore(off) {
+			stdlog.Printf("log: %d.store in %s is empty and has no index, creating one", off, l.Dir)
+			continue
+		}
+		for _, ext := range []string{".store", ".index"} {
+			if err := checkHeader(path.Join(l.Dir, fmt.Sprintf("%d%s", off, ext))); err != nil {
+				damage = append(damage, Damage{BaseOffset: off, Err: err})
+				break
+			}
+		}
+	}
+	return damage, nil
+}
+
+// Checks that the file exists and, unless it's empty, starts with a header that can be read.
+func checkHeader(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fStat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fStat.Size() == 0 {
+		return nil
+	}
+	if _, err = readHeader(f, uint64(fStat.Size())); err != nil {
+		return fmt.Errorf("%s: %w", path.Base(name), err)
+	}
+	return nil
+}
+
+// Whether the segment at off has no index and a store holding nothing but, at most, its header.
+// Anything that can't be read is left for the rest of the check to report.
+func (l *Log) isUnindexedEmptyStore(off uint64) bool {
+	_, err := os.Stat(path.Join(l.Dir, fmt.Sprintf("%d.index", off)))
+	if !os.IsNotExist(err) {
+		return false
+	}
+	f, err := os.Open(path.Join(l.Dir, fmt.Sprintf("%d.store", off)))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fStat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	if fStat.Size() == 0 {
+		return true
+	}
+	hdr, err := readHeader(f, uint64(fStat.Size()))
+	return err == nil && hdr.width() == uint64(fStat.Size())
+}
+
+// The rest of the full check. Verifies every segment but the active one, which has been
+// recovered on opening and is about to be appended to, and returns what's wrong with them.
+func (l *Log) verifyClosed() []Damage {
+	var damage []Damage
+	for i, s := range l.segments {
+		if s == l.activeSegment {
+			continue
+		}
+		if i > 0 && i%integrityProgressEvery == 0 {
+			stdlog.Printf("log: verifying %s: %d of %d segments", l.Dir, i, len(l.segments))
+		}
+		if err := s.verifyIndexAgainstStore(context.Background()); err != nil {
+			damage = append(damage, Damage{BaseOffset: s.baseOffset, Err: err})
+		}
+	}
+	return damage
+}
+
+// Returns the damage found when the log was opened, along with an ErrStoreDirty for the active
+// segment if a failed append has left its store dirty. A log with damage is degraded: it can be
+// read but appends fail with ErrDegraded.
+func (l *Log) Damage() []Damage {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]Damage(nil), l.damage...)
+}
+
+// Degrades the log if a failed append left the active segment's store dirty, so appends fail
+// with ErrDegraded until Recover is called rather than each running into ErrStoreDirty. Caller
+// holds the write lock.
+func (l *Log) checkDirty() {
+	if !l.activeSegment.store.dirty {
+		return
+	}
+	stdlog.Printf("log: append to segment %d failed partway, serving %s read-only until it's recovered", l.activeSegment.baseOffset, l.Dir)
+	l.damage = append(l.damage, Damage{BaseOffset: l.activeSegment.baseOffset, Err: ErrStoreDirty})
+	l.degraded = true
+}
+
+// Whether the log's damage includes a dirty store. Caller holds the lock.
+func (l *Log) isDirty() bool {
+	for _, d := range l.damage {
+		if d.Err == ErrStoreDirty {
+			return true
+		}
+	}
+	return false
+}
+
+// Recovers the log after a failed append left the active segment's store dirty, see
+// segment.Recover, and lifts the degraded mode that put the log in. Returns how many offsets were
+// rolled back: records that were acknowledged but never reached the file, whose offsets will be
+// handed out again. Damage found when the log was opened is left as it is, so a log opened
+// degraded stays degraded.
+func (l *Log) Recover() (rolledBack uint64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.isDirty() {
+		return 0, nil
+	}
+	if rolledBack, err = l.activeSegment.Recover(); err != nil {
+		return 0, err
+	}
+	var damage []Damage
+	for _, d := range l.damage {
+		if d.Err != ErrStoreDirty {
+			damage = append(damage, d)
+		}
+	}
+	l.damage = damage
+	l.degraded = len(l.damage) > 0
+	return rolledBack, nil
+}
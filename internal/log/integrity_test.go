@@ -0,0 +1,219 @@
+package log
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	api "github.com/peytonrunyan/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// Writes five records over three segments into a new directory and closes the log.
+func writeIntegrityLog(t *testing.T) (string, Config) {
+	t.Helper()
+	dir, _ := ioutil.TempDir("", "integrity-test")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 2
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+	return dir, c
+}
+
+func TestIntegrityClean(t *testing.T) {
+	dir, c := writeIntegrityLog(t)
+	for _, check := range []IntegrityCheck{IntegrityQuick, IntegrityFull} {
+		c.Integrity.Check = check
+		l, err := NewLog(dir, c)
+		require.NoError(t, err)
+		require.Empty(t, l.Damage())
+		_, err = l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.NoError(t, l.Close())
+	}
+}
+
+// A record cut off by a crash is dropped when the segment is opened, it isn't damage
+func TestIntegrityTornTail(t *testing.T) {
+	dir, c := writeIntegrityLog(t)
+	name := path.Join(dir, "4.store")
+	fStat, err := os.Stat(name)
+	require.NoError(t, err)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 100, 1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	c.Integrity.Check = IntegrityQuick
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Empty(t, l.Damage())
+	require.Equal(t, uint64(fStat.Size()), l.activeSegment.store.Size())
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+}
+
+func TestIntegrityCorruptedSegment(t *testing.T) {
+	dir, c := writeIntegrityLog(t)
+	f, err := os.OpenFile(path.Join(dir, "0.store"), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	pos := int64(headerWidth + lenWidth + crcWidth + 2)
+	_, err = f.WriteAt([]byte{0xff}, pos)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// the quick check doesn't read records
+	c.Integrity.Check = IntegrityQuick
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, l.Damage())
+	require.NoError(t, l.Close())
+
+	c.Integrity.Check = IntegrityFull
+	_, err = NewLog(dir, c)
+	var integrity *IntegrityError
+	require.True(t, errors.As(err, &integrity))
+	require.Len(t, integrity.Damage, 1)
+	require.Equal(t, uint64(0), integrity.Damage[0].BaseOffset)
+	require.True(t, errors.Is(integrity.Damage[0].Err, ErrChecksumMismatch))
+
+	// degraded, the log can be read but not appended to
+	c.Integrity.ServeDegraded = true
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, integrity.Damage, l.Damage())
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrDegraded, err)
+	_, err = l.AppendBatch([]*api.Record{{Value: []byte("hello world")}})
+	require.Equal(t, ErrDegraded, err)
+	record, err := l.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
+
+func TestIntegrityMissingIndex(t *testing.T) {
+	dir, c := writeIntegrityLog(t)
+	require.NoError(t, os.Remove(path.Join(dir, "2.index")))
+
+	c.Integrity.Check = IntegrityQuick
+	_, err := NewLog(dir, c)
+	var integrity *IntegrityError
+	require.True(t, errors.As(err, &integrity))
+	require.Equal(t, uint64(2), integrity.Damage[0].BaseOffset)
+	_, err = os.Stat(path.Join(dir, "2.index"))
+	require.True(t, os.IsNotExist(err), "the check shouldn't create the missing index")
+
+	// degraded, the segment is left out rather than opened with an empty index
+	c.Integrity.ServeDegraded = true
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Len(t, l.segments, 2)
+	_, err = l.Read(2)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 2}, err)
+	_, err = l.Read(4)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	// a check that runs out of time doesn't get as far as the damage
+	c.Integrity.ServeDegraded = false
+	c.Integrity.QuickBudget = time.Nanosecond
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, l.Damage())
+	require.NoError(t, l.Close())
+}
+
+// An append that fails partway leaves the active store dirty. The log is degraded until it's
+// recovered, after which appends carry on from the last record that reached the file.
+func TestIntegrityDirtyStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "integrity-test")
+	defer os.RemoveAll(dir)
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer l.Close()
+
+	want := &api.Record{Value: []byte("hello world")}
+	_, err = l.Append(want)
+	require.NoError(t, err)
+	require.NoError(t, l.Sync())
+	// nothing more can reach the file, and the third record overflows the 32 byte buffer
+	store := l.activeSegment.store
+	store.buf = bufio.NewWriterSize(&quotaWriter{w: store.File, left: 0}, 32)
+	_, err = l.Append(want)
+	require.NoError(t, err)
+	_, err = l.Append(want)
+	require.Error(t, err)
+	require.NotEqual(t, ErrDegraded, err)
+
+	_, err = l.Append(want)
+	require.Equal(t, ErrDegraded, err)
+	_, err = l.AppendBatch([]*api.Record{want})
+	require.Equal(t, ErrDegraded, err)
+	require.Equal(t, []Damage{{BaseOffset: 0, Err: ErrStoreDirty}}, l.Damage())
+
+	rolledBack, err := l.Recover()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), rolledBack) // offset 1 was acknowledged but never hit the file
+	require.Empty(t, l.Damage())
+	off, err := l.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	offsets, err := l.AppendBatch([]*api.Record{want})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2}, offsets)
+	for off := uint64(0); off < 3; off++ {
+		got, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+}
+
+// A crash while a segment is being created can leave a store with no records and no index. That
+// isn't damage, the segment is opened and gets a new index.
+func TestIntegrityEmptyStoreWithoutIndex(t *testing.T) {
+	for _, headerOnly := range []bool{false, true} {
+		dir, c := writeIntegrityLog(t)
+		c.Integrity.Check = IntegrityFull
+		l, err := NewLog(dir, c)
+		require.NoError(t, err)
+		_, err = l.Append(&api.Record{Value: []byte("hello world")}) // segment 4 is full
+		require.NoError(t, err)
+		require.NoError(t, l.Close())
+
+		f, err := os.Create(path.Join(dir, "6.store"))
+		require.NoError(t, err)
+		if headerOnly {
+			s, err := newStore(f, c)
+			require.NoError(t, err)
+			require.Equal(t, s.start, s.Size())
+			require.NoError(t, s.Close())
+		} else {
+			require.NoError(t, f.Close())
+		}
+
+		l, err = NewLog(dir, c)
+		require.NoError(t, err)
+		require.Empty(t, l.Damage())
+		require.Len(t, l.segments, 4)
+		_, err = os.Stat(path.Join(dir, "6.index"))
+		require.NoError(t, err)
+		off, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(6), off)
+		require.NoError(t, l.Close())
+	}
+}
@@ -0,0 +1,640 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	api "github.com/peytonrunyan/proglog/api/v1"
+)
+
+// Returned by HighestOffset when the log has no records.
+var ErrEmptyLog = fmt.Errorf("log is empty")
+
+// Returned by Append and AppendBatch when given a nil record, which there is nothing to store for.
+var ErrNilRecord = fmt.Errorf("record is nil")
+
+type Log struct {
+	mu sync.RWMutex
+
+	Dir    string // directory the segments' files live in
+	Config Config
+
+	activeSegment *segment      // segment that's currently being appended to
+	segments      []*segment    // every segment in the log, ordered by baseOffset
+	appended      chan struct{} // closed and replaced whenever records are appended
+	durable       uint64        // every offset below this has been synced to stable storage
+	synced        chan struct{} // closed and replaced whenever durable advances
+
+	damage   []Damage // found by the integrity check when the log was opened, or by a failed append
+	degraded bool     // set when there's damage, the log refuses appends
+
+	stopRetention  chan struct{} // closed by Close to stop the background retention check
+	retentionDone  chan struct{} // closed once the background retention check has stopped
+	stopRetentionO sync.Once
+}
+
+// Creates a log in the given directory. If the directory already holds segments (e.g. after a
+// restart) they are reopened in baseOffset order, otherwise a first segment is created at
+// Config.Segment.InitialOffset. Unset max sizes default to 1024 bytes.
+func NewLog(dir string, c Config) (*Log, error) {
+	if c.Segment.MaxStoreBytes == 0 {
+		c.Segment.MaxStoreBytes = 1024
+	}
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = 1024
+	}
+	l := &Log{
+		Dir:      dir,
+		Config:   c,
+		appended: make(chan struct{}),
+		synced:   make(chan struct{}),
+	}
+	if err := l.setup(); err != nil {
+		return nil, err
+	}
+	if c.Integrity.Check >= IntegrityFull {
+		l.damage = append(l.damage, l.verifyClosed()...)
+	}
+	if len(l.damage) > 0 {
+		if !c.Integrity.ServeDegraded {
+			l.Close()
+			return nil, &IntegrityError{Damage: l.damage}
+		}
+		stdlog.Printf("log: %s has %d damaged segments, serving it read-only", dir, len(l.damage))
+		l.degraded = true
+	}
+	// whatever was there when the log was opened came off the disk
+	l.durable = l.activeSegment.nextOffset
+	if c.Retention.CheckInterval > 0 {
+		l.stopRetention = make(chan struct{})
+		l.retentionDone = make(chan struct{})
+		go l.enforceRetentionEvery(c.Retention.CheckInterval)
+	}
+	return l, nil
+}
+
+// Rebuilds the segment list from the files in the log's directory. Each segment has a store,
+// an index, and possibly a meta file all named after its baseOffset, so the store files are
+// enough to find every segment.
+func (l *Log) setup() error {
+	files, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return err
+	}
+	var baseOffsets []uint64
+	for _, file := range files {
+		if path.Ext(file.Name()) != ".store" {
+			continue
+		}
+		offStr := strings.TrimSuffix(file.Name(), ".store")
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			return fmt.Errorf("unexpected store file %s: %w", file.Name(), err)
+		}
+		baseOffsets = append(baseOffsets, off)
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+	damaged := make(map[uint64]bool)
+	if l.Config.Integrity.Check >= IntegrityQuick {
+		ctx := context.Background()
+		if budget := l.Config.Integrity.QuickBudget; budget > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, budget)
+			defer cancel()
+		}
+		if l.damage, err = l.checkFiles(ctx, baseOffsets); err != nil {
+			return err
+		}
+		if len(l.damage) > 0 && !l.Config.Integrity.ServeDegraded {
+			return &IntegrityError{Damage: l.damage}
+		}
+		for _, d := range l.damage {
+			damaged[d.BaseOffset] = true
+		}
+	}
+	for _, off := range baseOffsets {
+		if damaged[off] { // served degraded without the segments that can't be opened
+			continue
+		}
+		if err = l.newSegment(off); err != nil {
+			return err
+		}
+	}
+	if l.segments == nil {
+		if len(baseOffsets) > 0 {
+			return &IntegrityError{Damage: l.damage} // nothing left to serve
+		}
+		return l.newSegment(l.Config.Segment.InitialOffset)
+	}
+	return nil
+}
+
+// Creates a segment starting at the given offset and makes it the active segment. The segment
+// it takes over from is sealed by flushing its store, so that the store file's modification
+// time, which retention goes by, is no earlier than the segment's last append.
+func (l *Log) newSegment(off uint64) error {
+	if l.activeSegment != nil {
+		if err := l.activeSegment.store.Flush(); err != nil {
+			return err
+		}
+	}
+	s, err := newSegment(l.Dir, off, l.Config)
+	if err != nil {
+		return err
+	}
+	l.segments = append(l.segments, s)
+	l.activeSegment = s
+	return nil
+}
+
+// Appends the record to the active segment and returns its offset. If the active segment is
+// full, a new segment is rolled starting at the next offset first. A degraded log, see Damage,
+// returns ErrDegraded.
+func (l *Log) Append(record *api.Record) (uint64, error) {
+	return l.AppendContext(context.Background(), record)
+}
+
+// Append, but gives up with ctx.Err() if ctx is done before the record is written, including
+// while waiting for the lock.
+func (l *Log) AppendContext(ctx context.Context, record *api.Record) (uint64, error) {
+	if record == nil {
+		return 0, ErrNilRecord
+	}
+	if err := l.lockContext(ctx); err != nil {
+		return 0, err
+	}
+	defer l.mu.Unlock()
+	if l.degraded {
+		return 0, ErrDegraded
+	}
+	if l.activeSegment.IsMaxed() {
+		if err := l.newSegment(l.activeSegment.nextOffset); err != nil {
+			return 0, err
+		}
+	}
+	off, err := l.activeSegment.Append(record)
+	if err != nil {
+		l.checkDirty()
+		return 0, err
+	}
+	l.notifyAppended()
+	return off, nil
+}
+
+// Appends the records as a batch and returns their offsets. A batch is never split across
+// segments: if it won't fit in what's left of the active segment, a new segment is rolled
+// first so that the whole batch lands in one segment. A batch with more records than a
+// segment's index can hold is rejected, unless indexes grow.
+//
+// As with Append, a failed write partway through leaves the records before it in the log.
+func (l *Log) AppendBatch(records []*api.Record) ([]uint64, error) {
+	return l.AppendBatchContext(context.Background(), records)
+}
+
+// AppendBatch, but gives up with ctx.Err() if ctx is done before the batch is written. Once
+// writing starts the whole batch is written, so a batch is never cut short by ctx.
+func (l *Log) AppendBatchContext(ctx context.Context, records []*api.Record) ([]uint64, error) {
+	for _, record := range records {
+		if record == nil {
+			return nil, ErrNilRecord
+		}
+	}
+	if err := l.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer l.mu.Unlock()
+	if l.degraded {
+		return nil, ErrDegraded
+	}
+	if l.Config.Segment.IndexGrowBytes == 0 &&
+		uint64(len(records))*entryWidth > l.Config.Segment.MaxIndexBytes {
+		return nil, fmt.Errorf("batch of %d records won't fit in a segment", len(records))
+	}
+	// records are marshalled with their offsets, which don't depend on the segment they land in
+	var size uint64
+	for i, record := range records {
+		record.Offset = l.activeSegment.nextOffset + uint64(i)
+		size += l.activeSegment.store.prefix + uint64(proto.Size(record))
+	}
+	if l.activeSegment.IsMaxed() || !l.activeSegment.Fits(size, uint64(len(records))) {
+		if err := l.newSegment(l.activeSegment.nextOffset); err != nil {
+			return nil, err
+		}
+	}
+	offsets, err := l.activeSegment.AppendBatch(records)
+	if len(offsets) > 0 {
+		l.notifyAppended()
+	}
+	if err != nil {
+		l.checkDirty()
+	}
+	return offsets, err
+}
+
+// Flushes and fsyncs every segment that has records appended since the last Sync, then marks
+// them durable for WaitDurable.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.segments {
+		if s.nextOffset > l.durable {
+			if err := s.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	if next := l.activeSegment.nextOffset; next > l.durable {
+		l.durable = next
+		close(l.synced)
+		l.synced = make(chan struct{})
+	}
+	return nil
+}
+
+// Waits until the record at off has been synced to stable storage by Sync. Returns ctx.Err()
+// if ctx is done first.
+func (l *Log) WaitDurable(ctx context.Context, off uint64) error {
+	for {
+		l.mu.RLock()
+		durable, synced := l.durable, l.synced
+		l.mu.RUnlock()
+		if off < durable {
+			return nil
+		}
+		select {
+		case <-synced:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Returns a channel that's closed the next time records are appended, for readers that have
+// caught up with the log to wait on. Get the channel before reading so that an append between
+// the read and the wait isn't missed.
+func (l *Log) Appended() <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.appended
+}
+
+// Takes the write lock unless ctx is done. Mutexes can't be interrupted, so ctx is checked
+// before waiting for the lock and again once it's held, in case it was cancelled while waiting.
+func (l *Log) lockContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	if err := ctx.Err(); err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Wakes everyone waiting on Appended. Caller holds the write lock.
+func (l *Log) notifyAppended() {
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// Reads the record at the given offset from whichever segment holds it. Returns
+// api.ErrOffsetOutOfRange if no segment does.
+//
+// A record that can't be decoded is handled as Config.Read.OnUndecodable says: Read returns an
+// ErrUndecodable, the next record that can be decoded, or the stored bytes in a record marked
+// Undecodable. Skipping past the last record is an api.ErrOffsetOutOfRange for off.
+func (l *Log) Read(off uint64) (*api.Record, error) {
+	return l.ReadContext(context.Background(), off)
+}
+
+// Read, but gives up with ctx.Err() if ctx is done before the record is read, including while
+// waiting for the lock.
+func (l *Log) ReadContext(ctx context.Context, off uint64) (*api.Record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// records that can't be decoded are skipped over by moving on to the next offset
+	for next := off; ; next++ {
+		var s *segment
+		for _, segment := range l.segments {
+			if segment.baseOffset <= next && next < segment.nextOffset {
+				s = segment
+				break
+			}
+		}
+		if s == nil {
+			return nil, api.ErrOffsetOutOfRange{Offset: off}
+		}
+		record, err := s.Read(next)
+		if !errors.Is(err, ErrUndecodable{}) {
+			return record, err
+		}
+		switch l.Config.Read.OnUndecodable {
+		case DecodeSkip:
+			continue
+		case DecodeRaw:
+			return record, nil
+		default:
+			return nil, err
+		}
+	}
+}
+
+// Returns how many bytes the record at the given offset takes up on disk, framing included,
+// without reading it. Returns api.ErrOffsetOutOfRange if no segment holds the offset.
+func (l *Log) RecordSize(off uint64) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		if s.baseOffset <= off && off < s.nextOffset {
+			return s.RecordSize(off)
+		}
+	}
+	return 0, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+// Returns the offset of the first record in the log.
+func (l *Log) LowestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.segments[0].baseOffset, nil
+}
+
+// Returns the offset of the last record in the log, or ErrEmptyLog if there isn't one, either
+// because nothing has been appended or because retention has removed every record.
+func (l *Log) HighestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	off := l.activeSegment.nextOffset
+	if off == l.segments[0].baseOffset {
+		return 0, ErrEmptyLog
+	}
+	return off - 1, nil
+}
+
+// Removes every segment whose records are all below lowest, deleting their files. The active
+// segment is always kept. Reads of removed offsets return api.ErrOffsetOutOfRange.
+func (l *Log) Truncate(lowest uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var segments []*segment
+	for _, s := range l.segments {
+		if s != l.activeSegment && s.nextOffset <= lowest {
+			if err := s.Remove(); err != nil {
+				return err
+			}
+			continue
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	return nil
+}
+
+// Removes the oldest segments until the log is within Config.Retention. Segments whose stores
+// haven't been written to for longer than MaxAge are removed, as are as many of the oldest
+// segments as it takes to bring the stores' total size down to MaxBytes. Segments are only ever
+// removed from the front of the log, and the active segment is always kept.
+func (l *Log) EnforceRetention() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := l.Config.Retention
+	var total uint64
+	for _, s := range l.segments {
+		total += s.store.Size()
+	}
+	cutoff := time.Now().Add(-r.MaxAge)
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		expired := false
+		if r.MaxAge > 0 {
+			fStat, err := s.store.File.Stat()
+			if err != nil {
+				return err
+			}
+			expired = fStat.ModTime().Before(cutoff)
+		}
+		if !expired && (r.MaxBytes == 0 || total <= r.MaxBytes) {
+			break
+		}
+		total -= s.store.Size()
+		if err := s.Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+// Calls EnforceRetention every interval until Close is called. A failure is logged and tried
+// again next time rather than stopping the log, since a segment that couldn't be removed now
+// (e.g. while its files are briefly locked by another process) may well be removable later.
+func (l *Log) enforceRetentionEvery(interval time.Duration) {
+	defer close(l.retentionDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.EnforceRetention(); err != nil {
+				stdlog.Printf("log: enforcing retention on %s: %v", l.Dir, err)
+			}
+		case <-l.stopRetention:
+			return
+		}
+	}
+}
+
+// Describes how much a segment holds. Byte counts don't include the files' headers.
+type SegmentProfile struct {
+	BaseOffset     uint64
+	Records        uint64
+	StoreBytes     uint64  // length-prefixed records in the store
+	IndexBytes     uint64  // entries in the index
+	AvgRecordBytes float64 // StoreBytes per record, 0 for an empty segment
+}
+
+// Returns a profile of each segment in baseOffset order. Appends are held off while the profiles
+// are taken, so they're a consistent snapshot of the log.
+func (l *Log) SegmentProfiles() []SegmentProfile {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	profiles := make([]SegmentProfile, len(l.segments))
+	for i, s := range l.segments {
+		p := SegmentProfile{
+			BaseOffset: s.baseOffset,
+			Records:    s.Records(),
+			StoreBytes: s.store.Size() - s.store.start,
+			IndexBytes: s.index.size - s.index.header.width(),
+		}
+		if p.Records > 0 {
+			p.AvgRecordBytes = float64(p.StoreBytes) / float64(p.Records)
+		}
+		profiles[i] = p
+	}
+	return profiles
+}
+
+// Returns a reader over every record in the log, e.g. for taking a backup. The segments' stores
+// are read back to back in baseOffset order, giving the raw records as they're framed in the
+// stores (the length, then the checksum in stores that have them) so they can be replayed.
+// Store headers are skipped so that the stream is nothing but records.
+//
+// Each store is read up to its size when Reader is called, so records appended afterwards
+// aren't part of the snapshot.
+func (l *Log) Reader() io.Reader {
+	return l.ReaderContext(context.Background())
+}
+
+// Reader, but once ctx is done the reader's Reads fail with ctx.Err().
+func (l *Log) ReaderContext(ctx context.Context) io.Reader {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	readers := make([]io.Reader, len(l.segments))
+	for i, segment := range l.segments {
+		readers[i] = &originReader{
+			store: segment.store,
+			off:   int64(segment.store.start),
+			end:   int64(segment.store.Size()),
+		}
+	}
+	return &ctxReader{ctx: ctx, r: io.MultiReader(readers...)}
+}
+
+// Returns a reader like Reader's, but starting at the record with offset off rather than at the
+// first record, so a transfer that was cut off can pick up where it left off. The record's
+// position in its store is found through the segment's index. Starting at the offset the next
+// record will be given is allowed, and gives a reader with nothing in it; any other offset
+// outside the log is an ErrOffsetOutOfRange.
+func (l *Log) ReaderFrom(off uint64) (io.Reader, error) {
+	return l.ReaderFromContext(context.Background(), off)
+}
+
+// ReaderFrom, but once ctx is done the reader's Reads fail with ctx.Err().
+func (l *Log) ReaderFromContext(ctx context.Context, off uint64) (io.Reader, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if off == l.activeSegment.nextOffset {
+		return &ctxReader{ctx: ctx, r: io.MultiReader()}, nil
+	}
+	var readers []io.Reader
+	for _, segment := range l.segments {
+		if off >= segment.nextOffset {
+			continue
+		}
+		if readers == nil {
+			if off < segment.baseOffset {
+				return nil, api.ErrOffsetOutOfRange{Offset: off}
+			}
+			_, pos, err := segment.index.Read(int64(off - segment.baseOffset))
+			if err != nil {
+				return nil, err
+			}
+			readers = append(readers, &originReader{
+				store: segment.store,
+				off:   int64(pos),
+				end:   int64(segment.store.Size()),
+			})
+			continue
+		}
+		readers = append(readers, &originReader{
+			store: segment.store,
+			off:   int64(segment.store.start),
+			end:   int64(segment.store.Size()),
+		})
+	}
+	if readers == nil {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return &ctxReader{ctx: ctx, r: io.MultiReader(readers...)}, nil
+}
+
+// Checks ctx before each Read of r.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Checks that every segment's index lines up with its store, see
+// segment.VerifyIndexAgainstStore.
+func (l *Log) Verify() error {
+	return l.VerifyContext(context.Background())
+}
+
+// Verify, but stops with ctx.Err() if ctx is done, checking between records.
+func (l *Log) VerifyContext(ctx context.Context) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		if err := s.verifyIndexAgainstStore(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads a store from off through to end. Reads go through the store's ReadAt, so
+// its buffer is flushed before the file is read.
+type originReader struct {
+	*store
+	off int64 // where the next Read picks up
+	end int64 // where the reader stops
+}
+
+func (o *originReader) Read(p []byte) (int, error) {
+	if o.off >= o.end {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > o.end-o.off {
+		p = p[:o.end-o.off]
+	}
+	n, err := o.ReadAt(p, o.off)
+	o.off += int64(n)
+	if err == io.EOF && o.off < o.end {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Stops the background retention check, if there is one, and closes every segment in the log.
+func (l *Log) Close() error {
+	if l.stopRetention != nil {
+		// stop the retention check before taking the lock it needs
+		l.stopRetentionO.Do(func() { close(l.stopRetention) })
+		<-l.retentionDone
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, segment := range l.segments {
+		if err := segment.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
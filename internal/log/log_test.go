@@ -0,0 +1,681 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	api "github.com/peytonrunyan/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "log-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 3 // force a few segments
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	_, err = l.Read(0)
+	require.Error(t, err) // nothing has been written yet
+
+	want := &api.Record{Value: []byte("hello world")}
+	for i := uint64(0); i < 8; i++ {
+		off, err := l.Append(want)
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	require.Len(t, l.segments, 3)
+
+	for i := uint64(0); i < 8; i++ {
+		got, err := l.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, i, got.Offset)
+	}
+	_, err = l.Read(8)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 8}, err)
+	size, err := l.RecordSize(7)
+	require.NoError(t, err)
+	require.Equal(t, l.activeSegment.store.prefix+uint64(proto.Size(&api.Record{Value: want.Value, Offset: 7})), size)
+	_, err = l.RecordSize(8)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 8}, err)
+	require.NoError(t, l.Close())
+
+	// reopen the log as if after a restart, the segments should be rebuilt in order and
+	// appends should carry on where they left off
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Len(t, l.segments, 3)
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), highest)
+
+	for i := uint64(0); i < 8; i++ {
+		got, err := l.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, i, got.Offset)
+	}
+	off, err := l.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), off)
+	require.NoError(t, l.Close())
+}
+
+// A new log starts at the configured initial offset
+func TestLogInitialOffset(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "log-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.InitialOffset = 16
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	_, err = l.HighestOffset()
+	require.Equal(t, ErrEmptyLog, err)
+
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), off)
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), lowest)
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), highest)
+}
+
+// Reader should return every record in the log, across segments, as raw length-prefixed bytes
+func TestLogReader(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "log-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 2
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	want := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(want)
+		require.NoError(t, err)
+	}
+	require.Len(t, l.segments, 2)
+
+	b, err := ioutil.ReadAll(l.Reader())
+	require.NoError(t, err)
+	var size uint64
+	for _, s := range l.segments {
+		size += s.store.Size() - s.store.start
+	}
+	require.Equal(t, size, uint64(len(b)))
+
+	// replay the stream
+	enc, prefix := l.segments[0].store.enc, l.segments[0].store.prefix
+	for i := uint64(0); i < 3; i++ {
+		n := enc.Uint64(b[:lenWidth])
+		got := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b[prefix:prefix+n], got))
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, i, got.Offset)
+		b = b[prefix+n:]
+	}
+	require.Empty(t, b)
+}
+
+// Reading from an offset should give the same records as reading them one at a time from there
+func TestLogReaderFrom(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "log-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	for i := 0; i < 8; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Truncate(2))
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+
+	enc, prefix := l.segments[0].store.enc, l.segments[0].store.prefix
+	for off := lowest; off <= 8; off++ {
+		r, err := l.ReaderFrom(off)
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		for want := off; want < 8; want++ {
+			record, err := l.Read(want)
+			require.NoError(t, err)
+			n := enc.Uint64(b[:lenWidth])
+			got := &api.Record{}
+			require.NoError(t, proto.Unmarshal(b[prefix:prefix+n], got))
+			require.Equal(t, record.Offset, got.Offset)
+			require.Equal(t, record.Value, got.Value)
+			b = b[prefix+n:]
+		}
+		require.Empty(t, b)
+	}
+
+	for _, off := range []uint64{lowest - 1, 9} {
+		_, err = l.ReaderFrom(off)
+		require.True(t, errors.Is(err, api.ErrOffsetOutOfRange{}))
+	}
+}
+
+// Each decode policy against a record that fails its checksum and one that passes it but can't
+// be unmarshalled
+func TestLogUndecodable(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "log-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	// 0 and 3 are fine, 1 and 4 are corrupted and 2 isn't a record at all
+	garbage := []byte{0xff, 0xff}
+	for i := 0; i < 5; i++ {
+		if i == 2 {
+			s := l.activeSegment
+			_, pos, err := s.store.Append(garbage)
+			require.NoError(t, err)
+			require.NoError(t, s.index.Write(uint32(s.nextOffset-s.baseOffset), pos))
+			s.nextOffset++
+			continue
+		}
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Sync())
+	stored := map[uint64][]byte{}
+	for _, off := range []uint64{1, 4} {
+		s := l.segments[off/3]
+		_, pos, err := s.index.Read(int64(off - s.baseOffset))
+		require.NoError(t, err)
+		f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0644)
+		require.NoError(t, err)
+		b := make([]byte, s.store.prefix+4)
+		_, err = f.ReadAt(b, int64(pos))
+		require.NoError(t, err)
+		b[len(b)-1] ^= 0xff
+		_, err = f.WriteAt(b[len(b)-1:], int64(pos)+int64(len(b)-1))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		stored[off] = make([]byte, s.store.enc.Uint64(b))
+		_, err = s.store.ReadAt(stored[off], int64(pos+s.store.prefix))
+		require.NoError(t, err)
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		l.Config.Read.OnUndecodable = DecodeFail
+		_, err := l.Read(1)
+		require.Equal(t, ErrUndecodable{Offset: 1, Err: ErrChecksumMismatch}, err)
+		require.True(t, errors.Is(err, ErrChecksumMismatch))
+		record, err := l.Read(2)
+		require.Nil(t, record)
+		require.True(t, errors.Is(err, ErrUndecodable{}))
+		require.False(t, errors.Is(err, ErrChecksumMismatch))
+		_, err = l.Read(3)
+		require.NoError(t, err)
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		l.Config.Read.OnUndecodable = DecodeSkip
+		for _, off := range []uint64{1, 2} {
+			record, err := l.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, uint64(3), record.Offset)
+			require.Equal(t, []byte("record 3"), record.Value)
+		}
+		// nothing after the last record to skip to
+		_, err := l.Read(4)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: 4}, err)
+	})
+
+	t.Run("raw", func(t *testing.T) {
+		l.Config.Read.OnUndecodable = DecodeRaw
+		for off, want := range map[uint64][]byte{1: stored[1], 2: garbage, 4: stored[4]} {
+			record, err := l.Read(off)
+			require.NoError(t, err)
+			require.True(t, record.Undecodable)
+			require.Equal(t, off, record.Offset)
+			require.Equal(t, want, record.Value)
+		}
+		record, err := l.Read(0)
+		require.NoError(t, err)
+		require.False(t, record.Undecodable)
+	})
+}
+
+// A batch that won't fit in the active segment should go to a new segment rather than being
+// split across two
+func TestLogAppendBatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "log-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 5
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	batch := func(n int) []*api.Record {
+		records := make([]*api.Record, n)
+		for i := range records {
+			records[i] = &api.Record{Value: []byte("hello world")}
+		}
+		return records
+	}
+
+	offsets, err := l.AppendBatch(batch(3))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, offsets)
+	require.Len(t, l.segments, 1)
+
+	// only two entries are left in the first segment
+	offsets, err = l.AppendBatch(batch(3))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3, 4, 5}, offsets)
+	require.Len(t, l.segments, 2)
+	require.Equal(t, uint64(3), l.segments[1].baseOffset)
+	require.Equal(t, uint64(3), l.segments[0].nextOffset)
+	for i := uint64(0); i < 6; i++ {
+		got, err := l.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, got.Offset)
+	}
+
+	// the same goes for the store
+	l.Config.Segment.MaxStoreBytes = l.segments[1].store.Size() - l.segments[1].store.start + 1
+	l.activeSegment.config = l.Config
+	offsets, err = l.AppendBatch(batch(1))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{6}, offsets)
+	require.Len(t, l.segments, 3)
+
+	_, err = l.AppendBatch(batch(6))
+	require.Error(t, err)
+
+	// nothing is appended from a batch holding a nil record
+	_, err = l.AppendBatch([]*api.Record{{Value: []byte("hello world")}, nil})
+	require.Equal(t, ErrNilRecord, err)
+	_, err = l.Append(nil)
+	require.Equal(t, ErrNilRecord, err)
+	require.Equal(t, uint64(7), l.activeSegment.nextOffset)
+}
+
+func TestLogTruncate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "log-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 2
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Len(t, l.segments, 3) // [0, 1] [2, 3] [4]
+
+	require.NoError(t, l.Truncate(3))
+	require.Len(t, l.segments, 2) // offset 3 is still needed, so [2, 3] stays
+	_, err = l.Read(1)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 1}, err)
+	require.True(t, errors.Is(err, api.ErrOffsetOutOfRange{}))
+	_, err = l.Read(5) // and past the end
+	require.True(t, errors.Is(err, api.ErrOffsetOutOfRange{}))
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, f := range files {
+		require.NotEqual(t, "0.store", f.Name())
+		require.NotEqual(t, "0.index", f.Name())
+	}
+
+	// the active segment is kept even though everything in it is below lowest
+	require.NoError(t, l.Truncate(100))
+	require.Len(t, l.segments, 1)
+	got, err := l.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), got.Offset)
+}
+
+func TestLogEnforceRetention(t *testing.T) {
+	newLog := func(t *testing.T) *Log {
+		dir, _ := ioutil.TempDir("", "log-test")
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		c := Config{}
+		c.Segment.MaxIndexBytes = entryWidth * 2
+		l, err := NewLog(dir, c)
+		require.NoError(t, err)
+		t.Cleanup(func() { l.Close() })
+		for i := 0; i < 5; i++ {
+			_, err := l.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+		require.Len(t, l.segments, 3)
+		return l
+	}
+
+	t.Run("bytes", func(t *testing.T) {
+		l := newLog(t)
+		// room for the last two segments, but not all three
+		l.Config.Retention.MaxBytes = l.segments[1].store.Size() + l.segments[2].store.Size()
+		require.NoError(t, l.EnforceRetention())
+		require.Len(t, l.segments, 2)
+		lowest, err := l.LowestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), lowest)
+
+		// never removes the active segment
+		l.Config.Retention.MaxBytes = 1
+		require.NoError(t, l.EnforceRetention())
+		require.Len(t, l.segments, 1)
+		_, err = l.Read(4)
+		require.NoError(t, err)
+	})
+
+	t.Run("age", func(t *testing.T) {
+		l := newLog(t)
+		l.Config.Retention.MaxAge = time.Hour
+		old := time.Now().Add(-2 * time.Hour)
+		require.NoError(t, os.Chtimes(l.segments[0].store.Name(), old, old))
+		require.NoError(t, l.EnforceRetention())
+		require.Len(t, l.segments, 2)
+		_, err := l.Read(1)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: 1}, err)
+
+		// old enough to go, but it's the active segment
+		require.NoError(t, os.Chtimes(l.segments[0].store.Name(), old, old))
+		require.NoError(t, os.Chtimes(l.segments[1].store.Name(), old, old))
+		require.NoError(t, l.EnforceRetention())
+		require.Len(t, l.segments, 1)
+	})
+
+	// a segment's age goes by its last append, not by when it was created
+	t.Run("last append", func(t *testing.T) {
+		dir, _ := ioutil.TempDir("", "log-test")
+		defer os.RemoveAll(dir)
+		c := Config{}
+		c.Segment.MaxIndexBytes = entryWidth * 2
+		c.Retention.MaxAge = time.Hour
+		l, err := NewLog(dir, c)
+		require.NoError(t, err)
+		defer l.Close()
+		record := &api.Record{Value: []byte("hello world")}
+		_, err = l.Append(record)
+		require.NoError(t, err)
+		old := time.Now().Add(-2 * time.Hour)
+		require.NoError(t, os.Chtimes(l.segments[0].store.Name(), old, old))
+		for i := 0; i < 2; i++ { // the second append rolls a new segment
+			_, err = l.Append(record)
+			require.NoError(t, err)
+		}
+		require.Len(t, l.segments, 2)
+		require.NoError(t, l.EnforceRetention())
+		require.Len(t, l.segments, 2)
+	})
+
+	t.Run("background", func(t *testing.T) {
+		dir, _ := ioutil.TempDir("", "log-test")
+		defer os.RemoveAll(dir)
+		c := Config{}
+		c.Segment.MaxIndexBytes = entryWidth * 2
+		c.Retention.MaxAge = time.Hour
+		c.Retention.CheckInterval = time.Millisecond
+		l, err := NewLog(dir, c)
+		require.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			_, err := l.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+
+		// the first two segments age out without anyone asking
+		old := time.Now().Add(-2 * time.Hour)
+		for _, off := range []string{"0", "2"} {
+			require.NoError(t, os.Chtimes(path.Join(dir, off+".store"), old, old))
+		}
+		require.Eventually(t, func() bool {
+			lowest, err := l.LowestOffset()
+			return err == nil && lowest == 4
+		}, time.Second, time.Millisecond)
+		_, err = l.Read(4)
+		require.NoError(t, err)
+
+		// and the check stops with the log
+		require.NoError(t, l.Close())
+		select {
+		case <-l.retentionDone:
+		default:
+			t.Fatal("retention check still running after Close")
+		}
+	})
+}
+
+func TestLogSegmentProfiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "log-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 2
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	// two small records then a bigger one in the second segment
+	values := [][]byte{[]byte("a"), []byte("b"), []byte("hello world")}
+	var sizes []uint64
+	for _, v := range values {
+		record := &api.Record{Value: v}
+		off, err := l.Append(record)
+		require.NoError(t, err)
+		record.Offset = off
+		sizes = append(sizes, lenWidth+crcWidth+uint64(proto.Size(record)))
+	}
+
+	profiles := l.SegmentProfiles()
+	require.Equal(t, []SegmentProfile{
+		{
+			BaseOffset:     0,
+			Records:        2,
+			StoreBytes:     sizes[0] + sizes[1],
+			IndexBytes:     2 * entryWidth,
+			AvgRecordBytes: float64(sizes[0]+sizes[1]) / 2,
+		},
+		{
+			BaseOffset:     2,
+			Records:        1,
+			StoreBytes:     sizes[2],
+			IndexBytes:     entryWidth,
+			AvgRecordBytes: float64(sizes[2]),
+		},
+	}, profiles)
+}
+
+// A context that's cancelled after Err has been checked a number of times, for cancelling
+// partway through an operation.
+type countdownCtx struct {
+	context.Context
+	checks int
+}
+
+func (c *countdownCtx) Err() error {
+	if c.checks == 0 {
+		return context.Canceled
+	}
+	c.checks--
+	return nil
+}
+
+func TestLogContext(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "log-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 4
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 10; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	t.Run("append and read", func(t *testing.T) {
+		_, err := l.AppendContext(cancelled, &api.Record{Value: []byte("hello world")})
+		require.Equal(t, context.Canceled, err)
+		_, err = l.AppendBatchContext(cancelled, []*api.Record{{Value: []byte("hello world")}})
+		require.Equal(t, context.Canceled, err)
+		highest, err := l.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(9), highest) // nothing was appended
+
+		_, err = l.ReadContext(cancelled, 0)
+		require.Equal(t, context.Canceled, err)
+	})
+
+	t.Run("export", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := l.ReaderContext(ctx)
+		b := make([]byte, 16)
+		_, err := io.ReadFull(r, b)
+		require.NoError(t, err)
+		cancel()
+		_, err = r.Read(b)
+		require.Equal(t, context.Canceled, err)
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		// gets through a few records before the context is cancelled
+		err := l.VerifyContext(&countdownCtx{Context: context.Background(), checks: 6})
+		require.Equal(t, context.Canceled, err)
+		require.NoError(t, l.Verify()) // and nothing was changed
+	})
+}
+
+func TestLogWaitDurable(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "log-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 2
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	var off uint64
+	for i := 0; i < 3; i++ {
+		off, err = l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// nothing has been synced yet
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, l.WaitDurable(ctx, off))
+
+	done := make(chan error)
+	go func() { done <- l.WaitDurable(context.Background(), off) }()
+	require.NoError(t, l.Sync())
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("WaitDurable didn't return after Sync")
+	}
+	require.NoError(t, l.WaitDurable(context.Background(), 0))
+
+	// records appended after the sync aren't durable until the next one
+	off, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, l.WaitDurable(ctx, off))
+	require.NoError(t, l.Sync())
+	require.NoError(t, l.WaitDurable(context.Background(), off))
+}
+
+// Truncating past the first two of three segments deletes their files, and reads that race with
+// the truncation see either the record or an out of range error, never a closed file
+func TestLogTruncateSegments(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "log-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 2
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 6; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Len(t, l.segments, 3) // [0, 1] [2, 3] [4, 5]
+
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for off := uint64(0); off < 6; off++ {
+				if _, err := l.Read(off); err != nil && !errors.Is(err, api.ErrOffsetOutOfRange{}) {
+					errs <- err
+					return
+				}
+			}
+		}
+	}()
+	require.NoError(t, l.Truncate(4))
+	close(done)
+	require.NoError(t, <-errs)
+
+	require.Len(t, l.segments, 1)
+	for _, name := range []string{"0.store", "0.index", "0.meta", "2.store", "2.index", "2.meta"} {
+		_, err := os.Stat(path.Join(dir, name))
+		require.True(t, os.IsNotExist(err), name)
+	}
+	for off := uint64(0); off < 4; off++ {
+		_, err := l.Read(off)
+		require.True(t, errors.Is(err, api.ErrOffsetOutOfRange{}))
+	}
+	for off := uint64(4); off < 6; off++ {
+		got, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+	}
+}
@@ -0,0 +1,246 @@
+package log
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	api "github.com/peytonrunyan/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// A read-only view of a log directory that another process, normally a running server, is
+// writing to. It only ever opens the store files for reading and takes no locks the writer
+// knows about, so it can never hold the writer up.
+//
+// The view is only as new as the last Refresh. Refresh picks up new segments, drops segments
+// the writer has removed, and reads on from where it left off in each store. Only records that
+// are wholly in a store file are seen: anything still in the writer's buffer, or a record the
+// writer is partway through flushing, shows up on a later Refresh once it's complete. The
+// writer's indexes aren't used, since they're mapped and sized up front and can't be told apart
+// from unwritten space without the writer's state. Records are instead found by walking the
+// length-prefixed stores, so a Refresh reads every byte appended since the last one. The writer
+// doesn't flush a segment when it rolls a new one, so a newer segment can have records on disk
+// before an older one's are all there. The view stops at the first such gap until it's filled.
+//
+// A segment's store stays open until a Refresh finds the writer has removed it, so records in
+// segments removed since the last Refresh can still be read on systems that allow reading
+// unlinked files.
+type ReadOnlyLog struct {
+	mu       sync.RWMutex
+	Dir      string
+	segments []*readOnlySegment // in baseOffset order
+	next     uint64             // the offset after the last record before any gap
+}
+
+// The records found so far in one store file.
+type readOnlySegment struct {
+	baseOffset uint64
+	file       *os.File
+	enc        binary.ByteOrder
+	prefix     uint64   // bytes in front of each payload, given by the file's framing
+	positions  []uint64 // where each record starts, positions[i] is baseOffset+i
+	scanned    uint64   // where the next record will start
+}
+
+// Opens a read-only view of the log in dir and reads everything that's in it so far.
+func NewLogReadOnly(dir string) (*ReadOnlyLog, error) {
+	l := &ReadOnlyLog{Dir: dir}
+	if err := l.Refresh(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Brings the view up to date with the directory. Segments the writer has created since the
+// last Refresh are opened, segments it has removed are closed and dropped, and records that
+// have been flushed to any store since are found.
+func (l *ReadOnlyLog) Refresh() error {
+	files, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return err
+	}
+	present := make(map[uint64]bool)
+	for _, file := range files {
+		if path.Ext(file.Name()) != ".store" {
+			continue
+		}
+		offStr := strings.TrimSuffix(file.Name(), ".store")
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			return fmt.Errorf("unexpected store file %s: %w", file.Name(), err)
+		}
+		present[off] = true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	segments := l.segments[:0]
+	for _, s := range l.segments {
+		if present[s.baseOffset] {
+			segments = append(segments, s)
+			delete(present, s.baseOffset)
+			continue
+		}
+		if err := s.file.Close(); err != nil {
+			return err
+		}
+	}
+	l.segments = segments
+	for off := range present {
+		s, err := openReadOnlySegment(l.Dir, off)
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			l.segments = append(l.segments, s)
+		}
+	}
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].baseOffset < l.segments[j].baseOffset
+	})
+	l.next = 0
+	for i, s := range l.segments {
+		if err := s.scan(); err != nil {
+			return err
+		}
+		if i == 0 {
+			l.next = s.baseOffset
+		}
+		if s.baseOffset == l.next {
+			l.next += uint64(len(s.positions))
+		}
+	}
+	return nil
+}
+
+// Opens the store for the segment at off. Returns nil without an error if the writer has only
+// just created the store and hasn't finished its header, so it can be picked up next time.
+func openReadOnlySegment(dir string, off uint64) (*readOnlySegment, error) {
+	f, err := os.Open(path.Join(dir, fmt.Sprintf("%d.store", off)))
+	if os.IsNotExist(err) { // removed since the directory was listed
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fStat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := uint64(fStat.Size())
+	if size == 0 {
+		return nil, f.Close()
+	}
+	h, err := readHeader(f, size)
+	if err == ErrTruncatedHeader {
+		return nil, f.Close()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &readOnlySegment{
+		baseOffset: off,
+		file:       f,
+		enc:        h.enc,
+		prefix:     h.prefixWidth(),
+		scanned:    h.width(),
+	}, nil
+}
+
+// Walks the records written since the last scan, stopping at the first one that isn't wholly
+// in the file yet.
+func (s *readOnlySegment) scan() error {
+	fStat, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(fStat.Size())
+	length := make([]byte, lenWidth)
+	for s.scanned+s.prefix <= size {
+		if _, err := s.file.ReadAt(length, int64(s.scanned)); err != nil {
+			return err
+		}
+		end := s.scanned + s.prefix + s.enc.Uint64(length)
+		if end < s.scanned || end > size {
+			break
+		}
+		s.positions = append(s.positions, s.scanned)
+		s.scanned = end
+	}
+	return nil
+}
+
+// Reads the record at the given offset, as of the last Refresh.
+func (l *ReadOnlyLog) Read(off uint64) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		if off >= l.next {
+			break
+		}
+		if off < s.baseOffset || off >= s.baseOffset+uint64(len(s.positions)) {
+			continue
+		}
+		pos := s.positions[off-s.baseOffset]
+		prefix := make([]byte, s.prefix)
+		if _, err := s.file.ReadAt(prefix, int64(pos)); err != nil {
+			return nil, err
+		}
+		b := make([]byte, s.enc.Uint64(prefix))
+		if _, err := s.file.ReadAt(b, int64(pos+s.prefix)); err != nil {
+			return nil, err
+		}
+		if err := verifyChecksum(prefix, b, s.enc); err != nil {
+			return nil, err
+		}
+		record := &api.Record{}
+		err := proto.Unmarshal(b, record)
+		return record, err
+	}
+	return nil, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+// Returns the offset of the first record in the view. A directory with no segments in it yet
+// starts at 0.
+func (l *ReadOnlyLog) LowestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.segments) == 0 {
+		return 0, nil
+	}
+	return l.segments[0].baseOffset, nil
+}
+
+// Returns the offset of the last record in the view, or ErrEmptyLog if there isn't one.
+func (l *ReadOnlyLog) HighestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.segments) == 0 || l.next == l.segments[0].baseOffset {
+		return 0, ErrEmptyLog
+	}
+	return l.next - 1, nil
+}
+
+// Closes the view's store files. The writer and its files are left alone.
+func (l *ReadOnlyLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	for _, s := range l.segments {
+		if cerr := s.file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	l.segments = nil
+	return err
+}
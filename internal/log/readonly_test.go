@@ -0,0 +1,90 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/peytonrunyan/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// A reader on the same directory as a running writer should only ever see complete records, in
+// order, and catch up with everything the writer has flushed once it refreshes.
+func TestLogReadOnly(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "log-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 10
+	w, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer w.Close()
+
+	r, err := NewLogReadOnly(dir)
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = r.HighestOffset()
+	require.Equal(t, ErrEmptyLog, err)
+
+	const n = 500
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			if _, err := w.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))}); err != nil {
+				errc <- err
+				return
+			}
+			if i%7 == 0 {
+				if err := w.Sync(); err != nil {
+					errc <- err
+					return
+				}
+			}
+		}
+		errc <- nil
+	}()
+
+	// whatever the reader sees while the writer is going has to be right
+	for i := 0; i < 50; i++ {
+		require.NoError(t, r.Refresh())
+		highest, err := r.HighestOffset()
+		if err == ErrEmptyLog {
+			continue
+		}
+		require.NoError(t, err)
+		for off := uint64(0); off <= highest; off++ {
+			record, err := r.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, record.Offset)
+			require.Equal(t, []byte(fmt.Sprintf("record %d", off)), record.Value)
+		}
+	}
+	require.NoError(t, <-errc)
+
+	require.NoError(t, w.Sync())
+	require.NoError(t, r.Refresh())
+	highest, err := r.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(n-1), highest)
+	for off := uint64(0); off < n; off++ {
+		record, err := r.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), record.Value)
+	}
+	_, err = r.Read(n)
+	require.True(t, errors.Is(err, api.ErrOffsetOutOfRange{}))
+
+	// segments the writer drops are dropped by the reader on its next refresh
+	require.NoError(t, w.Truncate(100))
+	require.NoError(t, r.Refresh())
+	wLowest, err := w.LowestOffset()
+	require.NoError(t, err)
+	rLowest, err := r.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, wLowest, rLowest)
+	_, err = r.Read(0)
+	require.True(t, errors.Is(err, api.ErrOffsetOutOfRange{}))
+}
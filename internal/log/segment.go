@@ -2,7 +2,10 @@
 package log
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
 	"path"
 
@@ -16,6 +19,8 @@ type segment struct {
 	baseOffset uint64 // where our data starts in our INDEX FILE
 	nextOffset uint64 // where to append the next entry in our INDEX FILE
 	config     Config // info about max store and index file size
+	records    uint64 // number of records in the segment
+	metaName   string // file the record count is saved to when the segment is closed
 }
 
 // Called when a new segment needs to be added (e.g. when the current segment reaches its max size).
@@ -34,7 +39,7 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if err != nil {
 		return nil, err
 	}
-	if s.store, err = newStore(storeFile); err != nil {
+	if s.store, err = newStore(storeFile, c); err != nil {
 		return nil, err
 	}
 	// Create new index file, labeled with baseoffset
@@ -49,23 +54,67 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.index, err = newIndex(indexFile, c); err != nil {
 		return nil, err
 	}
-	// Tries to read last element of the index file. If the index is new, there won't be
-	// anything to read and this will return an error, so the nextOffset (next location
-	// to write) should be the base offset. Otherwise the next position should be the next
-	// byte after the end of last item.
-	if off, _, err := s.index.Read(-1); err != nil {
-		s.nextOffset = s.baseOffset
-	} else {
-		s.nextOffset = baseOffset + uint64(off) + 1
+	// The index is memory mapped, so the OS can persist it before the store's buffer has been
+	// flushed. After a crash this leaves index entries pointing past the end of the store, so
+	// drop them before working out where to resume.
+	if err = s.dropDanglingEntries(); err != nil {
+		return nil, err
+	}
+	s.setNextOffset()
+	s.metaName = path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".meta"))
+	if err = s.loadRecordCount(); err != nil {
+		return nil, err
 	}
 	return s, nil
 }
 
+// Loads the record count saved by the last Close and removes the meta file, so that if we
+// crash before closing again there's no stale count to pick up. If there's no meta file the
+// segment is either new or wasn't closed cleanly, so the count is taken from the index after
+// recovery has dropped any dangling entries.
+func (s *segment) loadRecordCount() error {
+	b, err := ioutil.ReadFile(s.metaName)
+	if err == nil && uint64(len(b)) == lenWidth {
+		s.records = s.store.enc.Uint64(b)
+		return os.Remove(s.metaName)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.countRecords()
+	if err == nil { // unreadable count, don't leave it lying around
+		return os.Remove(s.metaName)
+	}
+	return nil
+}
+
+// Recomputes the record count from the index, which holds one entry per record.
+func (s *segment) countRecords() {
+	s.records = (s.index.size - s.index.header.width()) / entryWidth
+}
+
+// Returns the number of records in the segment.
+func (s *segment) Records() uint64 {
+	return s.records
+}
+
+// Works out the offset the next record will get from the index. dropDanglingEntries leaves the
+// index dense, with entry k holding relative offset k, so a segment with n entries holds offsets
+// baseOffset through baseOffset+n-1 and the next is baseOffset+n. This doesn't depend on what the
+// last entry's offset says, which a partly written entry could get wrong.
+func (s *segment) setNextOffset() {
+	s.nextOffset = s.baseOffset + (s.index.size-s.index.header.width())/entryWidth
+}
+
 // Writes record to segment and returns the offset of the appended record.
 // This writes to the store's buffer and updates the index file with the offset
 // and position of the record.
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	recordOffset := s.nextOffset
+	// the index holds offsets relative to baseOffset as uint32s
+	if recordOffset-s.baseOffset > math.MaxUint32 {
+		return 0, fmt.Errorf("segment %d is full: the index can't hold more than 2^32 offsets", s.baseOffset)
+	}
 	record.Offset = recordOffset
 	p, err := proto.Marshal(record)
 	if err != nil {
@@ -73,6 +122,9 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	}
 	// append record to store
 	_, recordStart, err := s.store.Append(p)
+	if err != nil {
+		return 0, err
+	}
 	// update index to reflect newly appended record
 	if err = s.index.Write(
 		// index offset relative to base offset
@@ -82,29 +134,277 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 		return 0, err
 	}
 	s.nextOffset++
+	s.records++
 	return recordOffset, nil
 }
 
+// Returned by AppendBatch when the segment can't take the rest of the batch. The records before
+// it were appended, a new segment needs to be rolled for the others.
+var ErrSegmentFull = fmt.Errorf("segment is full, roll a new segment for the rest of the batch")
+
+// Appends the records and returns their offsets, writing them to the store in one go and then
+// adding their index entries. Only as many records as Fits allows are appended; if that isn't
+// all of them, the offsets of the ones that were are returned with ErrSegmentFull. As with
+// Append, a failed write returns the offsets of the records before it with the error.
+func (s *segment) AppendBatch(records []*api.Record) ([]uint64, error) {
+	payloads := make([][]byte, 0, len(records))
+	var storeBytes uint64
+	for i, record := range records {
+		record.Offset = s.nextOffset + uint64(i)
+		p, err := proto.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		storeBytes += s.store.prefix + uint64(len(p))
+		if !s.Fits(storeBytes, uint64(i+1)) || record.Offset-s.baseOffset > math.MaxUint32 {
+			break
+		}
+		payloads = append(payloads, p)
+	}
+	_, positions, err := s.store.AppendBatch(payloads)
+	offsets := make([]uint64, 0, len(positions))
+	for _, pos := range positions {
+		if ierr := s.index.Write(uint32(s.nextOffset-s.baseOffset), pos); ierr != nil {
+			return offsets, ierr
+		}
+		offsets = append(offsets, s.nextOffset)
+		s.nextOffset++
+		s.records++
+	}
+	if err == nil && len(offsets) < len(records) {
+		err = ErrSegmentFull
+	}
+	return offsets, err
+}
+
+// Recovers the segment after a failed Append left its store dirty. The store is truncated back
+// to its last complete record, and any index entries for records that were lost along with the
+// store's buffer are dropped, so the segment resumes after the last record that's on disk.
+//
+// Records that were still in the store's buffer when the write failed are gone even though
+// Append returned their offsets, so this returns how many offsets were rolled back. Those
+// offsets will be handed out again by later Appends.
+func (s *segment) Recover() (rolledBack uint64, err error) {
+	if err = s.store.Recover(); err != nil {
+		return 0, err
+	}
+	if err = s.dropDanglingEntries(); err != nil {
+		return 0, err
+	}
+	prev := s.nextOffset
+	s.setNextOffset()
+	s.countRecords()
+	return prev - s.nextOffset, nil
+}
+
+// Removes entries from the end of the index that can't be trusted, then cuts the store back to
+// the end of the last record that's still indexed, so the two line up again.
+//
+// newIndex has already cut the zero-filled tail off an index that wasn't closed cleanly, but
+// the size is still rounded down to a whole number of entries in case it wasn't. Entries are
+// then dropped, working backwards, while they are out of sequence or point at a record that
+// isn't fully contained in the store.
+func (s *segment) dropDanglingEntries() error {
+	hdr := s.index.header.width()
+	s.index.size = hdr + uint64(s.nearestMultiple(int64(s.index.size-hdr), int64(entryWidth)))
+	end := s.store.start
+	for s.index.size >= hdr+entryWidth {
+		relOffset, pos, err := s.index.Read(-1)
+		if err != nil {
+			return err
+		}
+		// the index is dense, so entry k always holds relative offset k
+		if uint64(relOffset) == (s.index.size-hdr)/entryWidth-1 {
+			recordEnd, ok, err := s.recordEnd(pos)
+			if err != nil {
+				return err
+			}
+			if ok {
+				end = recordEnd
+				break
+			}
+		}
+		s.index.size -= entryWidth
+	}
+	if s.store.Size() > end {
+		return s.store.Truncate(end)
+	}
+	return nil
+}
+
+// Returns where the record starting at pos ends in the store, and whether the whole record is
+// actually contained in the store.
+func (s *segment) recordEnd(pos uint64) (uint64, bool, error) {
+	size := s.store.Size()
+	if pos < s.store.start || pos+s.store.prefix > size {
+		return 0, false, nil
+	}
+	length := make([]byte, lenWidth)
+	if _, err := s.store.ReadAt(length, int64(pos)); err != nil {
+		return 0, false, err
+	}
+	end := pos + s.store.prefix + s.store.enc.Uint64(length)
+	if end < pos || end > size { // a garbage length can overflow
+		return 0, false, nil
+	}
+	return end, true, nil
+}
+
+// Returned when the record at Offset is in the log but can't be decoded, because it failed its
+// checksum or couldn't be unmarshalled. Err says which.
+type ErrUndecodable struct {
+	Offset uint64
+	Err    error
+}
+
+func (e ErrUndecodable) Error() string {
+	return fmt.Sprintf("record at offset %d can't be decoded: %v", e.Offset, e.Err)
+}
+
+func (e ErrUndecodable) Unwrap() error {
+	return e.Err
+}
+
+// Matches any ErrUndecodable, whatever its offset, so callers can use errors.Is.
+func (e ErrUndecodable) Is(target error) bool {
+	_, ok := target.(ErrUndecodable)
+	return ok
+}
+
 // Reads entry at a given offset by converting the offset to an index offset,
 // and then reading from the location in the store file indicated by the index.
+// Returns api.ErrOffsetOutOfRange if the offset isn't in the segment.
+//
+// If the record can't be decoded it returns an ErrUndecodable along with a record holding the
+// stored bytes as its value, with Undecodable set, for callers that want them anyway.
 func (s *segment) Read(offset uint64) (*api.Record, error) {
+	if offset < s.baseOffset || offset >= s.nextOffset {
+		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	}
 	_, storePosition, err := s.index.Read(int64(offset - s.baseOffset))
 	if err != nil {
 		return nil, err
 	}
 	entry, err := s.store.Read(storePosition)
-	if err != nil {
+	if err == nil {
+		record := &api.Record{}
+		if err = proto.Unmarshal(entry, record); err == nil {
+			return record, nil
+		}
+	} else if err != ErrChecksumMismatch {
 		return nil, err
 	}
-	record := &api.Record{}
-	err = proto.Unmarshal(entry, record)
-	return record, err
+	raw := &api.Record{Value: entry, Offset: offset, Undecodable: true}
+	return raw, ErrUndecodable{Offset: offset, Err: err}
 }
 
-// Check if we have exceeded limits for either our index or store. Returns bool.
+// Returns how many bytes the record at the given offset takes up in the store, its length prefix
+// and checksum included. Only the prefix is read, not the record.
+func (s *segment) RecordSize(offset uint64) (uint64, error) {
+	if offset < s.baseOffset || offset >= s.nextOffset {
+		return 0, api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	_, storePosition, err := s.index.Read(int64(offset - s.baseOffset))
+	if err != nil {
+		return 0, err
+	}
+	end, ok, err := s.recordEnd(storePosition)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("record at offset %d isn't contained in the store", offset)
+	}
+	return end - storePosition, nil
+}
+
+// Returns the position in the store file where the next record will begin, i.e. the
+// current size of the store. Safe to call alongside Append.
+func (s *segment) NextPosition() uint64 {
+	return s.store.Size()
+}
+
+// Walks every entry in the index, reads the record it points at in the store, and checks that
+// the record's offset matches the entry's. Returns an error naming the first offset whose index
+// entry doesn't line up with the store.
+func (s *segment) VerifyIndexAgainstStore() error {
+	return s.verifyIndexAgainstStore(context.Background())
+}
+
+// VerifyIndexAgainstStore, but stops with ctx.Err() if ctx is done, checking between records.
+func (s *segment) verifyIndexAgainstStore(ctx context.Context) error {
+	entries := (s.index.size - s.index.header.width()) / entryWidth
+	for i := uint64(0); i < entries; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		relOffset, storePosition, err := s.index.Read(int64(i))
+		if err != nil {
+			return err
+		}
+		offset := s.baseOffset + uint64(relOffset)
+		// a position that has drifted into the middle of a record reads a garbage length, so
+		// make sure the record fits in the store before reading it
+		_, ok, err := s.recordEnd(storePosition)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf(
+				"offset %d: index points at store position %d which doesn't start a complete record",
+				offset, storePosition,
+			)
+		}
+		entry, err := s.store.Read(storePosition)
+		if err != nil {
+			return fmt.Errorf("offset %d: reading store position %d: %w", offset, storePosition, err)
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(entry, record); err != nil {
+			return fmt.Errorf("offset %d: decoding record at store position %d: %w", offset, storePosition, err)
+		}
+		if record.Offset != offset {
+			return fmt.Errorf(
+				"offset %d: index points at store position %d which holds offset %d",
+				offset, storePosition, record.Offset,
+			)
+		}
+	}
+	return nil
+}
+
+// Persists the segment's records and index entries to stable storage. The store goes first so
+// that the index never points at records that aren't on disk.
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
+// Check if we have exceeded limits for either our index or store. File headers don't count
+// towards the limits, and nor does the index if it grows when it's full, though it can still
+// run out of relative offsets. Returns bool.
 func (s *segment) IsMaxed() bool {
-	return s.store.size >= s.config.Segment.MaxStoreBytes ||
-		s.index.size >= s.config.Segment.MaxIndexBytes
+	if s.config.Segment.IndexGrowBytes > 0 {
+		return s.store.size-s.store.start >= s.config.Segment.MaxStoreBytes ||
+			s.nextOffset-s.baseOffset > math.MaxUint32
+	}
+	return s.store.size-s.store.start >= s.config.Segment.MaxStoreBytes ||
+		s.index.size-s.index.header.width() >= s.config.Segment.MaxIndexBytes
+}
+
+// Check if records taking up storeBytes in the store (length prefixes included) and entries
+// index entries can be appended without pushing the segment past its limits. An empty segment
+// takes any number of bytes, the same as Append would, but never more entries than its index
+// has room for, unless the index grows.
+func (s *segment) Fits(storeBytes, entries uint64) bool {
+	indexBytes := s.index.size - s.index.header.width() + entries*entryWidth
+	if s.config.Segment.IndexGrowBytes == 0 && indexBytes > s.config.Segment.MaxIndexBytes {
+		return false
+	}
+	return s.store.size == s.store.start ||
+		s.store.size-s.store.start+storeBytes <= s.config.Segment.MaxStoreBytes
 }
 
 // Close the segment and delete its associated index and store files. Returns err.
@@ -118,10 +418,14 @@ func (s *segment) Remove() error {
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(s.metaName); err != nil {
+		return err
+	}
 	return nil
 }
 
-// Close the index and the store associated with the segment
+// Close the index and the store associated with the segment, and save the record count so the
+// next newSegment doesn't have to recompute it.
 func (s *segment) Close() error {
 	if err := s.index.Close(); err != nil {
 		return err
@@ -129,16 +433,21 @@ func (s *segment) Close() error {
 	if err := s.store.Close(); err != nil {
 		return err
 	}
-	return nil
+	b := make([]byte, lenWidth)
+	s.store.enc.PutUint64(b, s.records)
+	return ioutil.WriteFile(s.metaName, b, 0644)
 }
 
-// Returns the multiple of desiredMultiple nearest to the value of numToCheck.
-// TODO Used to determine index position I think (because of how negatives behave).
+// Returns the largest multiple of desiredMultiple that isn't more than numToCheck, i.e. rounds
+// numToCheck down to a multiple of desiredMultiple. Negative numbers round down too, away from
+// zero, rather than towards it as integer division would. Used to round the index's size down to
+// a whole number of entries.
 // Examples:
-//	- numToCheck = 10, desiredMultiple = 2, result = 10
-// 	- numToCheck = 6, desiredMultiple = 4, results = 4
-//	- numToCheck = -4, desiredMultiple = 2, result = -10
-func (s *segment) nearestMultiple(numToCheck, desiredMultiple uint64) uint64 {
+//   - numToCheck = 10, desiredMultiple = 2, result = 10
+//   - numToCheck = 6, desiredMultiple = 4, result = 4
+//   - numToCheck = -4, desiredMultiple = 2, result = -4
+//   - numToCheck = -5, desiredMultiple = 2, result = -6
+func (s *segment) nearestMultiple(numToCheck, desiredMultiple int64) int64 {
 	if numToCheck < 0 {
 		return ((numToCheck - desiredMultiple + 1) / desiredMultiple) * desiredMultiple
 	}
@@ -2,12 +2,18 @@
 package log
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 
+	"github.com/golang/protobuf/proto"
 	api "github.com/peytonrunyan/proglog/api/v1"
 	"github.com/stretchr/testify/require"
+	"github.com/tysonmote/gommap"
 )
 
 func TestSegment(t *testing.T) {
@@ -52,3 +58,432 @@ func TestSegment(t *testing.T) {
 	require.False(t, s.IsMaxed())
 
 }
+
+// NextPosition should always point at the start of the record written by the following Append
+func TestSegmentNextPosition(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-next-position-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, headerWidth, s.NextPosition())
+
+	for i := uint64(0); i < 3; i++ {
+		want := s.NextPosition()
+		off, err := s.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		_, pos, err := s.index.Read(int64(off - s.baseOffset))
+		require.NoError(t, err)
+		require.Equal(t, want, pos)
+	}
+	require.Equal(t, s.store.size, s.NextPosition())
+	require.NoError(t, s.Close())
+}
+
+// Simulates a crash where the index made it to disk but the store's buffer did not. Reopening
+// the segment should drop the index entries that point past the end of the store.
+func TestSegmentRecoversFromUnflushedStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-unflushed-store-test")
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	_, err = s.Append(want)
+	require.NoError(t, err)
+	require.NoError(t, s.store.buf.Flush()) // only the first record reaches the store file
+	for i := 0; i < 2; i++ {
+		_, err = s.Append(want)
+		require.NoError(t, err)
+	}
+
+	// crash: the OS persists the index mmap, but the store's buffer is lost and neither file
+	// is truncated by Close, so the index file is left at MaxIndexBytes
+	require.NoError(t, s.index.mmap.Sync(gommap.MS_SYNC))
+	require.NoError(t, s.index.file.Close())
+	require.NoError(t, s.store.File.Close())
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(17), s.nextOffset)
+	require.Equal(t, headerWidth+entryWidth, s.index.size)
+	require.Equal(t, headerWidth+recordWidth(t, want, 16), s.store.size)
+
+	got, err := s.Read(16)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+	_, err = s.Read(17)
+	require.Error(t, err)
+
+	// appends pick up where the durable data ends
+	off, err := s.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(17), off)
+	got, err = s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+	require.NoError(t, s.VerifyIndexAgainstStore())
+	require.NoError(t, s.Close())
+}
+
+// A crashed legacy index is zero-filled up to MaxIndexBytes and its store can end in a torn
+// record. The zero entries look like they point at the first record, so they must be rejected
+// by sequence rather than by position, and the torn bytes must be cut off the store.
+func TestSegmentRecoversCrashedLegacySegment(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-crashed-legacy-test")
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("hello world")}
+	writeLegacySegment(t, dir, 0, want, 2)
+	storeName := path.Join(dir, "0.store")
+	indexName := path.Join(dir, "0.index")
+	fStat, err := os.Stat(storeName)
+	require.NoError(t, err)
+	storeSize := uint64(fStat.Size())
+	// a third record whose length made it to disk but whose payload didn't
+	f, err := os.OpenFile(storeName, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 19, 'h', 'e'})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Truncate(indexName, 1024))
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), s.nextOffset)
+	require.Equal(t, 2*entryWidth, s.index.size)
+	require.Equal(t, storeSize, s.store.size)
+
+	off, err := s.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.NoError(t, s.VerifyIndexAgainstStore())
+	require.NoError(t, s.Close())
+}
+
+// Returns the number of bytes the record takes up in the store when written at offset.
+func recordWidth(t *testing.T, record *api.Record, offset uint64) uint64 {
+	t.Helper()
+	r := proto.Clone(record).(*api.Record)
+	r.Offset = offset
+	p, err := proto.Marshal(r)
+	require.NoError(t, err)
+	return lenWidth + crcWidth + uint64(len(p))
+}
+
+func TestSegmentVerifyIndexAgainstStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-verify-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.VerifyIndexAgainstStore())
+
+	// point offset 17's entry at offset 18's record
+	_, pos, err := s.index.Read(2)
+	require.NoError(t, err)
+	entryStart := s.index.header.width() + entryWidth
+	s.index.header.enc.PutUint64(s.index.mmap[entryStart+offWidth:entryStart+entryWidth], pos)
+
+	err = s.VerifyIndexAgainstStore()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "offset 17:")
+	require.Contains(t, err.Error(), "holds offset 18")
+
+	// point offset 17's entry into the middle of its own record, where the "length" is part
+	// of the payload
+	s.index.header.enc.PutUint64(s.index.mmap[entryStart+offWidth:entryStart+entryWidth], pos-5)
+	err = s.VerifyIndexAgainstStore()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "offset 17:")
+	require.Contains(t, err.Error(), "doesn't start a complete record")
+	require.NoError(t, s.Close())
+}
+
+// A failed store write loses the records still in the store's buffer. Recover should roll the
+// segment back to what's on disk and say how many acknowledged offsets were lost.
+func TestSegmentRecoverAfterPartialWrite(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-partial-write-test")
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	_, err = s.Append(want)
+	require.NoError(t, err)
+	require.NoError(t, s.store.buf.Flush()) // offset 16 reaches the file
+	// nothing more can reach the file, and the second record overflows the 32 byte buffer
+	s.store.buf = bufio.NewWriterSize(&quotaWriter{w: s.store.File, left: 0}, 32)
+
+	off, err := s.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(17), off)
+	_, err = s.Append(want)
+	require.Error(t, err)
+	_, err = s.Append(want)
+	require.Equal(t, ErrStoreDirty, err)
+
+	rolledBack, err := s.Recover()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), rolledBack) // offset 17 was acknowledged but never hit the file
+	require.Equal(t, uint64(17), s.nextOffset)
+	require.Equal(t, headerWidth+entryWidth, s.index.size)
+
+	off, err = s.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(17), off)
+	for off := uint64(16); off < 18; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+	}
+	require.NoError(t, s.VerifyIndexAgainstStore())
+	require.NoError(t, s.Close())
+}
+
+func TestSegmentRecordCount(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-record-count-test")
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), s.Records())
+	for i := uint64(1); i <= 3; i++ {
+		_, err = s.Append(want)
+		require.NoError(t, err)
+		require.Equal(t, i, s.Records())
+	}
+	require.NoError(t, s.Close())
+
+	// a clean close saves the count, and reopening consumes it
+	metaName := path.Join(dir, "16.meta")
+	require.FileExists(t, metaName)
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), s.Records())
+	require.NoFileExists(t, metaName)
+
+	// crash with one record lost in the store's buffer; the count is rebuilt from what survives
+	require.NoError(t, s.store.buf.Flush())
+	_, err = s.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), s.Records())
+	require.NoError(t, s.index.mmap.Sync(gommap.MS_SYNC))
+	require.NoError(t, s.index.file.Close())
+	require.NoError(t, s.store.File.Close())
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), s.Records())
+	require.NoError(t, s.Remove())
+	require.NoFileExists(t, metaName)
+}
+
+func TestSegmentNearestMultiple(t *testing.T) {
+	s := &segment{}
+	tests := []struct {
+		num, multiple, want int64
+	}{
+		{num: 10, multiple: 2, want: 10},
+		{num: 6, multiple: 4, want: 4},
+		{num: -4, multiple: 2, want: -4},
+		{num: -5, multiple: 2, want: -6},
+		{num: 0, multiple: 12, want: 0},
+		{num: 35, multiple: 12, want: 24},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, s.nearestMultiple(tt.num, tt.multiple), "%d, %d", tt.num, tt.multiple)
+	}
+}
+
+// Offsets outside the segment are out of range rather than an io.EOF from the index
+func TestSegmentReadOutOfRange(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	for _, off := range []uint64{15, 17} {
+		_, err = s.Read(off)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: off}, err)
+		require.True(t, errors.Is(err, api.ErrOffsetOutOfRange{}))
+	}
+}
+
+// Reopening a segment and appending to it should carry on from the next offset, with no gaps or
+// duplicates, including for base offsets beyond what a uint32 can hold
+func TestSegmentReopenAppend(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-reopen-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	for _, base := range []uint64{0, 16, 1<<32 + 5} {
+		want := uint64(0)
+		for round := 0; round < 3; round++ {
+			s, err := newSegment(dir, base, c)
+			require.NoError(t, err)
+			require.Equal(t, base+want, s.nextOffset)
+			for i := 0; i < 4; i++ {
+				off, err := s.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", want))})
+				require.NoError(t, err)
+				require.Equal(t, base+want, off)
+				want++
+			}
+			require.NoError(t, s.Close())
+		}
+
+		s, err := newSegment(dir, base, c)
+		require.NoError(t, err)
+		require.Equal(t, want, s.Records())
+		for i := uint64(0); i < want; i++ {
+			record, err := s.Read(base + i)
+			require.NoError(t, err)
+			require.Equal(t, base+i, record.Offset)
+			require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+		}
+		require.NoError(t, s.Close())
+	}
+}
+
+// A segment whose index grows only rolls when its store is full
+func TestSegmentIndexGrow(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-grow-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	c.Segment.IndexGrowBytes = entryWidth * 3
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.True(t, s.Fits(0, 100)) // the index doesn't limit a batch either
+	record := &api.Record{Value: []byte("x")}
+	var appended uint64
+	for !s.IsMaxed() {
+		_, err := s.Append(record)
+		require.NoError(t, err)
+		appended++
+	}
+	require.Greater(t, appended, uint64(3))
+	require.GreaterOrEqual(t, s.store.size-s.store.start, c.Segment.MaxStoreBytes)
+	for off := uint64(0); off < appended; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+	}
+	require.NoError(t, s.Close())
+}
+
+// A segment whose index grew past MaxIndexBytes opens with growth turned off, holding all its
+// records, and is full
+func TestSegmentReopenGrownIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-grow-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	c.Segment.IndexGrowBytes = entryWidth * 3
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	record := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 10; i++ {
+		_, err := s.Append(record)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	c.Segment.IndexGrowBytes = 0
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, uint64(10), s.nextOffset)
+	for off := uint64(0); off < 10; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+	}
+	require.True(t, s.IsMaxed())
+}
+
+// A batch that runs past the segment's limits is appended up to them, and the rest is left for
+// the next segment
+func TestSegmentAppendBatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-batch-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = entryWidth * 5
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	batch := func(n int) []*api.Record {
+		records := make([]*api.Record, n)
+		for i := range records {
+			records[i] = &api.Record{Value: []byte("hello world")}
+		}
+		return records
+	}
+	offsets, err := s.AppendBatch(batch(3))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{16, 17, 18}, offsets)
+
+	offsets, err = s.AppendBatch(batch(3))
+	require.Equal(t, ErrSegmentFull, err)
+	require.Equal(t, []uint64{19, 20}, offsets)
+	require.True(t, s.IsMaxed())
+	require.Equal(t, uint64(5), s.Records())
+	require.NoError(t, s.VerifyIndexAgainstStore())
+
+	offsets, err = s.AppendBatch(batch(1))
+	require.Equal(t, ErrSegmentFull, err)
+	require.Empty(t, offsets)
+	for off := uint64(16); off < 21; off++ {
+		record, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+}
@@ -3,36 +3,80 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
-var (
-	enc = binary.BigEndian
-)
-
+// Each record in a store is written as
+//
+//	length (lenWidth bytes) | crc (crcWidth bytes) | payload (length bytes)
+//
+// where crc is the CRC32-C of the payload. Stores written with fixed framing, see header.go,
+// have no crc. Either way the length only counts the payload, and a record's position is where
+// its length starts.
 const (
 	lenWidth = 8 // number of bytes used to store a record's length
+	crcWidth = 4 // number of bytes used to store a record's checksum
 )
 
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Returned by Read when a record's payload doesn't match the checksum written with it, i.e.
+// the store has been corrupted on disk.
+var ErrChecksumMismatch = fmt.Errorf("record checksum mismatch")
+
+// Returned by Append once a write has failed partway through a record. The store's size no
+// longer matches what's in the buffer and file, so it must be recovered before taking writes.
+var ErrStoreDirty = fmt.Errorf("store has a partially written record, call Recover")
+
 // abstraction to handle reading and writing data to and from disk
 type store struct {
-	File *os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer
-	size uint64 // The size of the store file, initially given by fstat.Size() in newStore()
+	flushed  uint64 // everything before this is in the file, accessed atomically (first for alignment)
+	File     *os.File
+	mu       sync.Mutex
+	buf      *bufio.Writer
+	size     uint64           // The size of the store file, initially given by fstat.Size() in newStore()
+	enc      binary.ByteOrder // byte order used for record lengths, given by the file's header
+	start    uint64           // where the first record begins, after the file's header
+	prefix   uint64           // bytes in front of each payload, given by the file's framing
+	dirty    bool             // set when an Append fails partway, cleared by Recover
+	torn     uint64           // bytes of the failed record that reached the buffer, beyond size
+	buffered bool             // set by Append, cleared when the buffer is flushed
+	scratch  []byte           // prefix being written by Append, reused since buf copies it
 }
 
-func newStore(f *os.File) (*store, error) {
+// Creates a store for the given file. New files get a header describing how they're encoded,
+// existing files are read using the encoding recorded in their header.
+func newStore(f *os.File, c Config) (*store, error) {
 	fStat, err := os.Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
 	size := uint64(fStat.Size())
+	var h header
+	if size == 0 {
+		if h, err = newHeader(c); err != nil {
+			return nil, err
+		}
+		if _, err = f.Write(h.encode()); err != nil { // the file is empty, so this lands at 0
+			return nil, err
+		}
+		size = h.width()
+	} else if h, err = readHeader(f, size); err != nil {
+		return nil, err
+	}
 	return &store{
-		File: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
+		File:    f,
+		size:    size,
+		flushed: size,
+		buf:     bufio.NewWriterSize(f, int(c.Store.WriteBufferSize)), // 0 gets bufio's default
+		enc:     h.enc,
+		start:   h.width(),
+		prefix:  h.prefixWidth(),
 	}, nil
 }
 
@@ -41,69 +85,276 @@ func newStore(f *os.File) (*store, error) {
 //
 // Note - writes to buf instead of to file to reduce total system calls (good for dealing with
 // high volumes of small messages), but this means that data is not written to storage in this call
+//
+// If the write fails partway the buffer and file may hold part of a record that size doesn't
+// account for, so the store is marked dirty and refuses writes with ErrStoreDirty until Recover
+// is called.
 func (s *store) Append(data []byte) (uint64, uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.append(data)
+}
+
+// Appends each of the records the way Append does, taking the mutex once for the lot. Returns
+// the number of bytes written and the starting position of each record. If a write fails the
+// records before it are still appended, and their byte counts and positions are returned along
+// with the error.
+func (s *store) AppendBatch(records [][]byte) ([]uint64, []uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ns := make([]uint64, 0, len(records))
+	positions := make([]uint64, 0, len(records))
+	for _, data := range records {
+		n, pos, err := s.append(data)
+		if err != nil {
+			return ns, positions, err
+		}
+		ns = append(ns, n)
+		positions = append(positions, pos)
+	}
+	return ns, positions, nil
+}
+
+// Append for callers holding the mutex.
+func (s *store) append(data []byte) (uint64, uint64, error) {
+	if s.dirty {
+		return 0, 0, ErrStoreDirty
+	}
 	recordStart := s.size
+	s.buffered = true
 
 	// Write size of data so that we know how far to read for this message.
 	// This is written as the binary representation of the uint64 length, so it
-	// will always be 64 bits in length.
-	if err := binary.Write(s.buf, enc, uint64(len(data))); err != nil {
-		return 0, 0, err
+	// will always be 64 bits in length. The checksum, if the store has them, follows it.
+	if s.scratch == nil {
+		s.scratch = make([]byte, s.prefix)
+	}
+	prefix := s.scratch
+	s.enc.PutUint64(prefix, uint64(len(data)))
+	if s.prefix > lenWidth {
+		s.enc.PutUint32(prefix[lenWidth:], crc32.Checksum(data, crcTable))
+	}
+	n, err := s.buf.Write(prefix)
+	if err != nil {
+		return 0, 0, s.fail(uint64(n), uint64(len(data)), err)
 	}
 	bytesWritten, err := s.buf.Write(data) // write the data itself
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, s.fail(uint64(n+bytesWritten), uint64(len(data)), err)
 	}
-	bytesWritten += lenWidth       // bytes written + offset for storing record length
+	bytesWritten += int(s.prefix)  // bytes written + offset for storing record length and checksum
 	s.size += uint64(bytesWritten) // update file size to reflect appended record
 	return uint64(bytesWritten), recordStart, nil
-
 }
 
-// Read a record at a given position. Returns a byte slice containing the record, and err
+// Read a record at a given position. Returns a byte slice containing the record, and err.
+// Returns ErrChecksumMismatch if the record doesn't match its checksum.
+//
+// Records that have already been flushed to the file are read without taking the mutex, so
+// readers of older records don't wait on the writer or each other.
 func (s *store) Read(pos uint64) ([]byte, error) {
+	if record, ok, err := s.readFlushed(pos); ok {
+		return record, err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
+	if err := s.flush(); err != nil {
 		return nil, err
 	}
-	size := make([]byte, lenWidth) // get size of our record
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+	prefix := make([]byte, s.prefix) // get size of our record
+	if _, err := s.File.ReadAt(prefix, int64(pos)); err != nil {
 		return nil, err
 	}
-	// make byte slice of record size and start read after lenWidth offset
-	recordSlice := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(recordSlice, int64(pos+lenWidth)); err != nil {
+	// make byte slice of record size and start read after the prefix
+	recordSlice := make([]byte, s.enc.Uint64(prefix))
+	if _, err := s.File.ReadAt(recordSlice, int64(pos+s.prefix)); err != nil {
 		return nil, err
 	}
-	return recordSlice, nil
+	return recordSlice, verifyChecksum(prefix, recordSlice, s.enc)
+}
+
+// Reads the record at pos straight from the file if the whole record has been flushed. Returns
+// false if it hasn't and the caller needs to flush first.
+func (s *store) readFlushed(pos uint64) ([]byte, bool, error) {
+	flushed := atomic.LoadUint64(&s.flushed)
+	if pos+s.prefix > flushed {
+		return nil, false, nil
+	}
+	prefix := make([]byte, s.prefix)
+	if _, err := s.File.ReadAt(prefix, int64(pos)); err != nil {
+		return nil, true, err
+	}
+	end := pos + s.prefix + s.enc.Uint64(prefix)
+	if end < pos || end > flushed {
+		return nil, false, nil
+	}
+	recordSlice := make([]byte, end-pos-s.prefix)
+	if _, err := s.File.ReadAt(recordSlice, int64(pos+s.prefix)); err != nil {
+		return nil, true, err
+	}
+	return recordSlice, true, verifyChecksum(prefix, recordSlice, s.enc)
+}
+
+// Checks a record's payload against the checksum in its prefix. Prefixes without a checksum,
+// from stores written with fixed framing, have nothing to check.
+func verifyChecksum(prefix, payload []byte, enc binary.ByteOrder) error {
+	if len(prefix) < lenWidth+crcWidth {
+		return nil
+	}
+	if enc.Uint32(prefix[lenWidth:]) != crc32.Checksum(payload, crcTable) {
+		return ErrChecksumMismatch
+	}
+	return nil
 }
 
 // Implements `ReadAt` on store with mutex and buffer flush. ReadAt reads len(b) bytes
 // starting at the offset, and writes them to byte slice b. It returns the number of bytes
 // read and error. The byte slice is mutated, not returned.
+//
+// As with Read, bytes that have already been flushed are read without taking the mutex.
 func (s *store) ReadAt(b []byte, offset int64) (int, error) {
+	if offset >= 0 && uint64(offset)+uint64(len(b)) <= atomic.LoadUint64(&s.flushed) {
+		return s.File.ReadAt(b, offset)
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
+	if err := s.flush(); err != nil {
 		return 0, err
 	}
 	return s.File.ReadAt(b, offset)
 }
 
-// Persist buffered data before closing file
-func (s *store) Close() error {
+// Flushes the buffer if anything has been appended since it was last flushed, so that readers
+// don't pay for a flush when there's nothing to write. The caller must hold the mutex.
+func (s *store) flush() error {
+	if !s.buffered {
+		return nil
+	}
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	s.buffered = false
+	atomic.StoreUint64(&s.flushed, s.size)
+	return nil
+}
+
+// Marks the store dirty after a write of a record with the given payload length failed with
+// only written bytes of it accepted by the buffer. Returns the error to hand back to the caller.
+func (s *store) fail(written, length uint64, err error) error {
+	s.dirty = true
+	s.torn = written
+	return fmt.Errorf("store append: wrote %d of %d bytes: %w", written, s.prefix+length, err)
+}
+
+// Brings a dirty store back to a consistent state. Anything still in the buffer is discarded,
+// since a failed write may have left it holding part of a record, and the file is truncated
+// back to the end of the last complete record it contains. The store's size is set to match,
+// so it can be less than before if earlier records never made it out of the buffer.
+func (s *store) Recover() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	err := s.buf.Flush()
+	if !s.dirty {
+		return nil
+	}
+	s.buf.Reset(s.File)
+	s.buffered = false
+	fStat, err := s.File.Stat()
 	if err != nil {
 		return err
 	}
+	fileSize := uint64(fStat.Size())
+	// walk the records in the file until we hit one that's incomplete
+	pos := s.start
+	size := make([]byte, lenWidth)
+	for pos+s.prefix <= fileSize && pos < s.size {
+		if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+			return err
+		}
+		end := pos + s.prefix + s.enc.Uint64(size)
+		if end > fileSize || end > s.size {
+			break
+		}
+		pos = end
+	}
+	if err := s.truncate(pos); err != nil {
+		return err
+	}
+	s.dirty = false
+	s.torn = 0
+	return nil
+}
+
+// Flushes the buffer and cuts the store back to the given size, dropping any records (or parts
+// of records) after it.
+func (s *store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.truncate(size)
+}
+
+// Truncates the file to size and moves the write position to match. The caller must hold the
+// mutex and make sure nothing past size is left in the buffer.
+func (s *store) truncate(size uint64) error {
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	// files not opened with O_APPEND would otherwise keep writing past the truncated end
+	if _, err := s.File.Seek(int64(size), io.SeekStart); err != nil {
+		return err
+	}
+	s.size = size
+	atomic.StoreUint64(&s.flushed, size)
+	return nil
+}
+
+// Flushes the buffer and fsyncs the file, so every record appended so far is on stable
+// storage. A dirty store's buffer can't be trusted, so it returns ErrStoreDirty instead.
+// Writes anything buffered out to the file, without waiting for it to reach stable storage.
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dirty {
+		return ErrStoreDirty
+	}
+	return s.flush()
+}
+
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dirty {
+		return ErrStoreDirty
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+// Persist buffered data before closing file. A dirty store's buffer can't be trusted, so it is
+// dropped instead.
+func (s *store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
 	return s.File.Close()
 }
 
+// Returns the size of the store, which is where the next record will begin. Includes records
+// that are still in the buffer.
+func (s *store) Size() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
 // Return the name of the store's underlying file.
 func (s *store) Name() string {
 	return s.File.Name()
@@ -1,6 +1,9 @@
 package log
 
 import (
+	"bufio"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -10,7 +13,7 @@ import (
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + lenWidth + crcWidth
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -18,29 +21,29 @@ func TestStoreAppendRead(t *testing.T) {
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
 
-	s, err := newStore(f)
+	s, err := newStore(f, Config{})
 	require.NoError(t, err)
 
 	testAppend(t, s)
 	testRead(t, s)
 	testReadAt(t, s)
 
-	s, err = newStore(f)
+	s, err = newStore(f, Config{})
 	require.NoError(t, err)
 	testRead(t, s)
 }
 
 // Since Append returns num bytes written and the previous starting position, we expect that
 // after each write of the same string, the previous position + the number of bytes written
-// will equal the size of item written*<the num times written>. This will be 8 bytes larger
+// will equal the size of item written*<the num times written>. This will be 12 bytes larger
 // than the length of written bytes because the start of each write is the length of the item
-// as a uint64
+// as a uint64 followed by its checksum. Records start after the store's header.
 func testAppend(t *testing.T, s *store) {
 	t.Helper()
 	for i := uint64(1); i < 4; i++ {
 		n, pos, err := s.Append(write)
 		require.NoError(t, err)
-		require.Equal(t, pos+n, width*i)
+		require.Equal(t, pos+n, headerWidth+width*i)
 	}
 }
 
@@ -48,7 +51,7 @@ func testAppend(t *testing.T, s *store) {
 // so we expect to be able to find it consistently.
 func testRead(t *testing.T, s *store) {
 	t.Helper()
-	var pos uint64
+	pos := headerWidth
 	for i := uint64(1); i < 4; i++ {
 		read, err := s.Read(pos)
 		require.NoError(t, err)
@@ -59,15 +62,15 @@ func testRead(t *testing.T, s *store) {
 
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
-	for i, off := uint64(1), int64(0); i < 4; i++ {
+	for i, off := uint64(1), int64(headerWidth); i < 4; i++ {
 		b := make([]byte, lenWidth) // reading the length of the record, not the record itself
 		n, err := s.ReadAt(b, off)
 		require.NoError(t, err)
 		require.Equal(t, lenWidth, n) // bytes read should be equal to the length of the record
 
-		size := enc.Uint64(b)
+		size := s.enc.Uint64(b)
 		b = make([]byte, size)
-		n, err = s.ReadAt(b, off+lenWidth)
+		n, err = s.ReadAt(b, off+lenWidth+crcWidth)
 		require.NoError(t, err)
 		require.Equal(t, write, b)
 		require.Equal(t, int(size), n)
@@ -80,7 +83,7 @@ func testClose(t *testing.T) {
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
 
-	s, err := newStore(f)
+	s, err := newStore(f, Config{})
 	require.NoError(t, err)
 
 	_, _, err = s.Append(write)
@@ -114,3 +117,204 @@ func openFile(fname string) (file *os.File, size int64, err error) {
 	}
 	return file, fStat.Size(), nil
 }
+
+// Simulates a file that runs out of quota partway through a record. The failed Append should
+// leave the store dirty until Recover truncates it back to its last complete record.
+func TestStoreRecoverAfterPartialWrite(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_partial_write_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	// a 48 byte buffer is flushed partway through the third and fifth records. The quota lets
+	// the first flush through but only 10 bytes of the second, cutting the third record short.
+	s.buf = bufio.NewWriterSize(&quotaWriter{w: f, left: 48 + 10}, 48)
+
+	var appended uint64
+	for ; appended < 10; appended++ {
+		if _, _, err = s.Append(write); err != nil {
+			break
+		}
+	}
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "quota exceeded")
+	require.True(t, s.dirty)
+	require.NotZero(t, s.torn)
+
+	_, _, err = s.Append(write)
+	require.Equal(t, ErrStoreDirty, err)
+
+	require.NoError(t, s.Recover())
+	require.False(t, s.dirty)
+	fStat, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, uint64(fStat.Size()), s.size)
+	// only the records that were flushed before the quota ran out survive
+	require.Equal(t, headerWidth+2*width, s.size)
+	require.Less(t, uint64(2), appended)
+
+	// the store is appendable again, and can be walked record by record
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, headerWidth+2*width, pos)
+	for pos := headerWidth; pos < s.size; pos += width {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+	require.NoError(t, s.Close())
+}
+
+// Writes through to w until left bytes have been written, then fails with a short write.
+type quotaWriter struct {
+	w    io.Writer
+	left uint64
+}
+
+func (q *quotaWriter) Write(p []byte) (int, error) {
+	if uint64(len(p)) <= q.left {
+		q.left -= uint64(len(p))
+		return q.w.Write(p)
+	}
+	n, err := q.w.Write(p[:q.left])
+	q.left = 0
+	if err != nil {
+		return n, err
+	}
+	return n, fmt.Errorf("quota exceeded")
+}
+
+// Reads only flush when something has been appended since the last flush, and the flushed
+// watermark tracks what's safe to read without the mutex
+func TestStoreFlushWatermark(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_flush_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	require.False(t, s.buffered)
+	require.Equal(t, s.start, s.flushed)
+
+	_, first, err := s.Append(write)
+	require.NoError(t, err)
+	require.True(t, s.buffered)
+	require.Equal(t, s.start, s.flushed) // still in the buffer
+
+	// reading a buffered record flushes it
+	got, err := s.Read(first)
+	require.NoError(t, err)
+	require.Equal(t, write, got)
+	require.False(t, s.buffered)
+	require.Equal(t, s.start+width, s.flushed)
+
+	// a record appended after the flush is read through the buffer, the first straight from the file
+	_, second, err := s.Append(write)
+	require.NoError(t, err)
+	got, err = s.Read(first)
+	require.NoError(t, err)
+	require.Equal(t, write, got)
+	require.True(t, s.buffered) // didn't need to flush
+	got, err = s.Read(second)
+	require.NoError(t, err)
+	require.Equal(t, write, got)
+	require.Equal(t, s.start+2*width, s.flushed)
+
+	// truncating moves the watermark back
+	require.NoError(t, s.Truncate(s.start+width))
+	require.Equal(t, s.start+width, s.flushed)
+	require.NoError(t, s.Close())
+}
+
+// A record corrupted on disk should fail its checksum rather than be handed back as garbage
+func TestStoreChecksumMismatch(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_checksum_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	_, first, err := s.Append(write)
+	require.NoError(t, err)
+	_, second, err := s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// flip a byte in the second record's payload
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	pos := int64(second + lenWidth + crcWidth + 3)
+	_, err = f.ReadAt(b, pos)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, pos)
+	require.NoError(t, err)
+
+	s, err = newStore(f, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.Read(first)
+	require.NoError(t, err)
+	require.Equal(t, write, got)
+	_, err = s.Read(second)
+	require.Equal(t, ErrChecksumMismatch, err)
+}
+
+// Records up to Config.Store.WriteBufferSize should stay in the buffer until it's flushed
+func TestStoreWriteBufferSize(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_buffer_size_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	require.Equal(t, 4096, s.buf.Size())
+	require.NoError(t, s.Close())
+
+	f, _, err = openFile(f.Name())
+	require.NoError(t, err)
+	c := Config{}
+	c.Store.WriteBufferSize = 64 << 10
+	s, err = newStore(f, c)
+	require.NoError(t, err)
+	require.Equal(t, 64<<10, s.buf.Size())
+
+	// bigger than the default buffer, but it fits in this one
+	_, _, err = s.Append(make([]byte, 32<<10))
+	require.NoError(t, err)
+	fStat, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(headerWidth), fStat.Size())
+	require.NoError(t, s.Close())
+}
+
+func TestStoreAppendBatch(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_append_batch_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	_, first, err := s.Append(write)
+	require.NoError(t, err)
+	ns, positions, err := s.AppendBatch([][]byte{write, write, write})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{width, width, width}, ns)
+	require.Equal(t, []uint64{first + width, first + 2*width, first + 3*width}, positions)
+	require.Equal(t, first+4*width, s.Size())
+	for _, pos := range positions {
+		got, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, got)
+	}
+
+	// a failed write keeps the records before it
+	s.buf = bufio.NewWriterSize(&quotaWriter{w: f, left: 0}, 32)
+	ns, positions, err = s.AppendBatch([][]byte{write, write, write})
+	require.Error(t, err)
+	require.Len(t, ns, 1)
+	require.Equal(t, []uint64{first + 4*width}, positions)
+	require.True(t, s.dirty)
+}
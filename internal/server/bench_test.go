@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	api "github.com/peytonrunyan/proglog/api/v1"
+	"github.com/peytonrunyan/proglog/internal/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const benchRecordSize = 1024
+
+func benchDir(b *testing.B) string {
+	dir, err := ioutil.TempDir("", "server-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func benchConfig() log.Config {
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64 << 20
+	c.Segment.MaxIndexBytes = 12 << 20
+	return c
+}
+
+func BenchmarkHTTPProduce(b *testing.B) {
+	srv, err := NewHTTPServer(":0", benchDir(b), benchConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer srv.Close()
+	body, _ := json.Marshal(ProduceRequest{Record: Record{Value: make([]byte, benchRecordSize)}})
+	b.SetBytes(benchRecordSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			b.Fatal(rec.Body.String())
+		}
+	}
+}
+
+func BenchmarkHTTPConsume(b *testing.B) {
+	const records = 1000
+	srv, err := NewHTTPServer(":0", benchDir(b), benchConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer srv.Close()
+	for i := 0; i < records; i++ {
+		if _, err := srv.log.Append(&api.Record{Value: make([]byte, benchRecordSize)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(benchRecordSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		body, _ := json.Marshal(ConsumeRequest{Offset: uint64(i % records)})
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			b.Fatal(rec.Body.String())
+		}
+	}
+}
+
+// Starts a gRPC server over bufconn and returns a client for it.
+func benchGRPCClient(b *testing.B) (api.LogClient, *log.Log) {
+	clog, err := log.NewLog(benchDir(b), benchConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { clog.Close() })
+	srv, err := NewGRPCServer(&Config{CommitLog: clog})
+	if err != nil {
+		b.Fatal(err)
+	}
+	l := bufconn.Listen(1024 * 1024)
+	go srv.Serve(l)
+	b.Cleanup(srv.Stop)
+	cc, err := grpc.Dial(
+		"bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { cc.Close() })
+	return api.NewLogClient(cc), clog
+}
+
+func BenchmarkGRPCProduce(b *testing.B) {
+	client, _ := benchGRPCClient(b)
+	req := &api.ProduceRequest{Record: &api.Record{Value: make([]byte, benchRecordSize)}}
+	ctx := context.Background()
+	b.SetBytes(benchRecordSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Produce(ctx, req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGRPCConsume(b *testing.B) {
+	const records = 1000
+	client, clog := benchGRPCClient(b)
+	for i := 0; i < records; i++ {
+		if _, err := clog.Append(&api.Record{Value: make([]byte, benchRecordSize)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	b.SetBytes(benchRecordSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Consume(ctx, &api.ConsumeRequest{Offset: uint64(i % records)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	api "github.com/peytonrunyan/proglog/api/v1"
+	"github.com/peytonrunyan/proglog/internal/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The log the servers produce to and consume from. *log.Log satisfies it.
+type CommitLog interface {
+	AppendContext(context.Context, *api.Record) (uint64, error)
+	ReadContext(context.Context, uint64) (*api.Record, error)
+	RecordSize(uint64) (uint64, error) // bytes the record takes up on disk, found without reading it
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	Appended() <-chan struct{} // closed the next time records are appended
+	Damage() []log.Damage      // appends fail while there is any, see log.Log.Damage
+}
+
+type Config struct {
+	CommitLog CommitLog
+}
+
+// Creates a gRPC server with the log service registered, serving config's CommitLog.
+// Consuming an offset that isn't in the log returns an OutOfRange status with the offset in
+// its details.
+func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
+	gsrv := grpc.NewServer(opts...)
+	srv, err := newgrpcServer(config)
+	if err != nil {
+		return nil, err
+	}
+	api.RegisterLogServer(gsrv, srv)
+	return gsrv, nil
+}
+
+var _ api.LogServer = (*grpcServer)(nil)
+
+// implements the log service generated from api/v1/log.proto
+type grpcServer struct {
+	api.UnimplementedLogServer
+	*Config
+}
+
+func newgrpcServer(config *Config) (*grpcServer, error) {
+	return &grpcServer{
+		Config: config,
+	}, nil
+}
+
+// appends the request's record to the log, returns its offset. A request without a record is an
+// InvalidArgument, and a degraded log is Unavailable.
+func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "produce request has no record")
+	}
+	offset, err := s.CommitLog.AppendContext(ctx, req.Record)
+	if errors.Is(err, log.ErrDegraded) {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &api.ProduceResponse{Offset: offset}, nil
+}
+
+// returns the record at the requested offset. api.ErrOffsetOutOfRange is converted to a status
+// by the gRPC server.
+func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	record, err := s.CommitLog.ReadContext(ctx, req.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ConsumeResponse{Record: record}, nil
+}
+
+// appends each record sent on the stream and sends back its offset, until the client closes
+// its side of the stream
+func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		res, err := s.Produce(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
+
+// sends every record from the requested offset on. Once it's caught up with the log it waits
+// for more records to be appended rather than returning, until the client cancels the stream.
+// Offsets below the start of the log are still out of range.
+func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	offset := req.Offset
+	for {
+		appended := s.CommitLog.Appended() // before reading, so no append slips past
+		res, err := s.Consume(stream.Context(), &api.ConsumeRequest{Offset: offset})
+		if errors.Is(err, api.ErrOffsetOutOfRange{}) {
+			lowest, lErr := s.CommitLog.LowestOffset()
+			if lErr != nil {
+				return lErr
+			}
+			if offset < lowest {
+				return err
+			}
+			select {
+			case <-appended:
+				continue
+			case <-stream.Context().Done():
+				return nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+		offset = res.Record.Offset + 1 // records that can't be decoded may have been skipped
+	}
+}
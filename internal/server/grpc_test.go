@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	api "github.com/peytonrunyan/proglog/api/v1"
+	"github.com/peytonrunyan/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Starts a gRPC server over bufconn backed by a log in a temp dir, and returns a client for it.
+func setupGRPC(t *testing.T, c log.Config) (api.LogClient, *log.Log) {
+	dir, _ := ioutil.TempDir("", "grpc-test")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	t.Cleanup(func() { clog.Close() })
+
+	srv, err := NewGRPCServer(&Config{CommitLog: clog})
+	require.NoError(t, err)
+	l := bufconn.Listen(1024 * 1024)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+
+	cc, err := grpc.Dial(
+		"bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { cc.Close() })
+	return api.NewLogClient(cc), clog
+}
+
+func TestGRPCServer(t *testing.T) {
+	client, _ := setupGRPC(t, log.Config{})
+	ctx := context.Background()
+
+	want := &api.Record{Value: []byte("hello world")}
+	for i := uint64(0); i < 3; i++ {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{Record: want})
+		require.NoError(t, err)
+		require.Equal(t, i, produce.Offset)
+
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+		require.NoError(t, err)
+		require.Equal(t, want.Value, consume.Record.Value)
+		require.Equal(t, i, consume.Record.Offset)
+	}
+
+	// offsets past the end of the log are OutOfRange, with the offset in the details
+	_, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 3})
+	st := status.Convert(err)
+	require.Equal(t, codes.OutOfRange, st.Code())
+	require.Len(t, st.Details(), 1)
+	info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+	require.True(t, ok)
+	require.Equal(t, "3", info.Metadata["offset"])
+}
+
+// A produce request without a record is rejected, on its own or on a stream, and nothing is
+// appended.
+func TestGRPCProduceNoRecord(t *testing.T) {
+	client, clog := setupGRPC(t, log.Config{})
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = clog.HighestOffset()
+	require.Equal(t, log.ErrEmptyLog, err)
+}
+
+func TestGRPCStreams(t *testing.T) {
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 1024
+	client, clog := setupGRPC(t, c)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	produce := func(from, to int) {
+		stream, err := client.ProduceStream(ctx)
+		require.NoError(t, err)
+		for i := from; i < to; i++ {
+			require.NoError(t, stream.Send(&api.ProduceRequest{
+				Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+			}))
+			res, err := stream.Recv()
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), res.Offset)
+		}
+		require.NoError(t, stream.CloseSend())
+		_, err = stream.Recv()
+		require.Equal(t, io.EOF, err)
+	}
+	produce(0, 200)
+
+	consume, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	for i := 0; i < 200; i++ {
+		res, err := consume.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), res.Record.Value)
+	}
+
+	// the stream has caught up with the log, records appended now should still come through
+	produce(200, 300)
+	for i := 200; i < 300; i++ {
+		res, err := consume.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), res.Record.Value)
+	}
+
+	// offsets below the start of the log are out of range rather than waited on
+	require.NoError(t, clog.Truncate(250))
+	lowest, err := clog.LowestOffset()
+	require.NoError(t, err)
+	require.NotZero(t, lowest)
+	truncated, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = truncated.Recv()
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	cancel()
+	_, err = consume.Recv()
+	require.Equal(t, codes.Canceled, status.Code(err))
+}
+
+// A stream started on an empty log should see records in order while they're being appended.
+func TestGRPCConsumeStreamTail(t *testing.T) {
+	client, clog := setupGRPC(t, log.Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	consume, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	const n = 500
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			record := &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}
+			if _, err := clog.Append(record); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+
+	for i := 0; i < n; i++ {
+		res, err := consume.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), res.Record.Value)
+	}
+	require.NoError(t, <-errc)
+
+	// a consumer that goes away while the stream is blocked on the log ends it
+	cancel()
+	_, err = consume.Recv()
+	require.Equal(t, codes.Canceled, status.Code(err))
+}
@@ -1,36 +1,98 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
 
 	"github.com/gorilla/mux"
+	api "github.com/peytonrunyan/proglog/api/v1"
+	"github.com/peytonrunyan/proglog/internal/log"
 )
 
-// wraps our log httpServer in an http.Server with handlers registered
-func NewHTTPServer(addr string) *http.Server {
-	httpServer := newHTTPServer()
+// An http.Server serving a log kept on disk. Shutdown and Close also close the log, so
+// everything that's been produced is there when a server is next started on the same directory.
+type HTTPServer struct {
+	*http.Server
+	log      *log.Log
+	sessions *sessions
+	sampler  *sampler
+}
+
+// wraps our log httpServer in an http.Server with handlers registered. The log's segments are
+// kept in dir, which is created if it doesn't exist.
+func NewHTTPServer(addr, dir string, c log.Config) (*HTTPServer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l, err := log.NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	httpServer := newHTTPServer(l)
 	r := mux.NewRouter()
 	r.HandleFunc("/", httpServer.handleProduce).Methods("POST")
 	r.HandleFunc("/", httpServer.handleConsume).Methods("Get")
-	return &http.Server{
-		Addr:    addr,
-		Handler: r,
+	r.HandleFunc("/offsets", httpServer.handleOffsets).Methods("GET")
+	r.HandleFunc("/sessions", httpServer.handleOpenSession).Methods("POST")
+	r.HandleFunc("/sessions/{id}/next", httpServer.handleSessionNext).Methods("GET")
+	r.HandleFunc("/admin/stats", httpServer.handleStats).Methods("GET")
+	r.HandleFunc("/sample", httpServer.handleSample).Methods("GET")
+	return &HTTPServer{
+		Server: &http.Server{
+			Addr:    addr,
+			Handler: r,
+		},
+		log:      l,
+		sessions: httpServer.sessions,
+		sampler:  httpServer.sampler,
+	}, nil
+}
+
+// Gracefully shuts down the server, then closes the log.
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	if err := s.Server.Shutdown(ctx); err != nil {
+		return err
 	}
+	return s.log.Close()
+}
+
+// Closes the server's listeners and connections, then closes the log.
+func (s *HTTPServer) Close() error {
+	if err := s.Server.Close(); err != nil {
+		return err
+	}
+	return s.log.Close()
 }
 
 // struct to hold our log and our handler methods
 type httpServer struct {
-	Log *Log
+	Log      CommitLog
+	sessions *sessions
+	sampler  *sampler
 }
 
 // don't confuse this with http.Server
-func newHTTPServer() *httpServer {
+func newHTTPServer(l CommitLog) *httpServer {
 	return &httpServer{
-		Log: NewLog(),
+		Log:      l,
+		sessions: newSessions(sessionTTL, maxSessionsPerClient),
+		sampler:  newSampler(sampleMaxBytes, sampleMaxTime),
 	}
 }
 
+type Record struct {
+	Value       []byte `json:"value"`
+	Offset      uint64 `json:"offset"`
+	Undecodable bool   `json:"undecodable,omitempty"` // value is the record's stored bytes, see log.DecodeRaw
+}
+
 type ProduceRequest struct {
 	Record Record `json:"record"`
 }
@@ -43,8 +105,80 @@ type ConsumeRequest struct {
 	Offset uint64 `json:"offset"`
 }
 
+// The record's fields are embedded so that consume keeps returning the bare record, with
+// next_offset alongside them.
 type ConsumeResponse struct {
-	Record Record `json:"record"`
+	Record
+	NextOffset uint64 `json:"next_offset"` // offset to request next
+}
+
+// The range of offsets in the log. Highest is null when the log is empty, in which case lowest
+// is where the first record will be written.
+type OffsetsResponse struct {
+	Lowest  uint64  `json:"lowest"`
+	Highest *uint64 `json:"highest"`
+}
+
+// Sent with a 404 when the requested offset isn't in the log, either because it's past the
+// head or because it's been truncated away.
+type OutOfRangeResponse struct {
+	Error  string `json:"error"`
+	Offset uint64 `json:"offset"`
+}
+
+// The state of the log. Degraded is set when damage was found as the log was opened, in which
+// case produce is refused and the damage is listed.
+type StatsResponse struct {
+	Degraded bool           `json:"degraded"`
+	Damage   []DamageReport `json:"damage"`
+}
+
+type DamageReport struct {
+	BaseOffset uint64 `json:"base_offset"` // the damaged segment
+	Problem    string `json:"problem"`
+}
+
+// Opens a session starting at offset, or at the lowest offset in the log if it's left out.
+type SessionRequest struct {
+	Offset *uint64 `json:"offset"`
+}
+
+type SessionResponse struct {
+	ID     string `json:"id"`
+	Offset uint64 `json:"offset"` // where the session's cursor starts
+}
+
+// The records handed out by a session, and where its cursor is now. Records is empty once the
+// session has caught up with the log.
+type SessionNextResponse struct {
+	Records    []Record `json:"records"`
+	NextOffset uint64   `json:"next_offset"`
+}
+
+// Sent with a 410 when a session has expired. NextOffset is where the session was up to, so the
+// client can carry on consuming by offset from there.
+type SessionExpiredResponse struct {
+	Error      string `json:"error"`
+	NextOffset uint64 `json:"next_offset"`
+}
+
+// most records a session hands out in one request
+const maxSessionCount = 1000
+
+// Records picked at random from across the log, with the sizes of their values. Partial is set
+// when the sample stopped short of the count asked for because it hit its byte or time limit.
+type SampleResponse struct {
+	Records []Record    `json:"records"`
+	Partial bool        `json:"partial"`
+	Sizes   SampleSizes `json:"sizes"`
+}
+
+// The smallest, median and largest value sizes in a sample, in bytes. All zero for an empty
+// sample.
+type SampleSizes struct {
+	Min    int `json:"min"`
+	Median int `json:"median"`
+	Max    int `json:"max"`
 }
 
 // unmarshalls request, appeds message to the log, returns offset
@@ -55,7 +189,11 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	off, err := s.Log.Append(req.Record) // append to log
+	off, err := s.Log.AppendContext(r.Context(), &api.Record{Value: req.Record.Value}) // append to log
+	if errors.Is(err, log.ErrDegraded) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -76,12 +214,229 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	record, err := s.Log.Read(req.Offset) // find record
+	record, err := s.Log.ReadContext(r.Context(), req.Offset) // find record
+	var outOfRange api.ErrOffsetOutOfRange
+	if errors.As(err, &outOfRange) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(OutOfRangeResponse{Error: err.Error(), Offset: outOfRange.Offset})
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := ConsumeResponse{
+		Record:     Record{Value: record.Value, Offset: record.Offset, Undecodable: record.Undecodable},
+		NextOffset: record.Offset + 1,
+	}
+	err = json.NewEncoder(w).Encode(resp) // return record and next offset
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// returns the lowest and highest offsets in the log
+func (s *httpServer) handleOffsets(w http.ResponseWriter, r *http.Request) {
+	lowest, err := s.Log.LowestOffset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := OffsetsResponse{Lowest: lowest}
+	highest, err := s.Log.HighestOffset()
+	if err == nil {
+		resp.Highest = &highest
+	} else if err != log.ErrEmptyLog {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(resp) // return offsets
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// reports whether the log is degraded and why
+func (s *httpServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	damage := s.Log.Damage()
+	resp := StatsResponse{Degraded: len(damage) > 0, Damage: []DamageReport{}}
+	for _, d := range damage {
+		resp.Damage = append(resp.Damage, DamageReport{BaseOffset: d.BaseOffset, Problem: d.Err.Error()})
+	}
+	err := json.NewEncoder(w).Encode(resp) // return stats
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// opens a session for the client and returns its ID
+func (s *httpServer) handleOpenSession(w http.ResponseWriter, r *http.Request) {
+	var req SessionRequest
+	err := json.NewDecoder(r.Body).Decode(&req) // unmarshall, the body is optional
+	if err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var start uint64
+	if req.Offset != nil {
+		start = *req.Offset
+	} else if start, err = s.Log.LowestOffset(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// sessions are limited per client, which is the remote host without its port
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	id, err := s.sessions.open(client, start)
+	if err == errSessionLimit {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(SessionResponse{ID: id, Offset: start}) // return session
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	err = json.NewEncoder(w).Encode(record) // return record
+}
+
+// returns up to count records from the session's cursor and moves the cursor past them
+func (s *httpServer) handleSessionNext(w http.ResponseWriter, r *http.Request) {
+	count := 1
+	if q := r.URL.Query().Get("count"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 1 || n > maxSessionCount {
+			http.Error(w, "count must be between 1 and "+strconv.Itoa(maxSessionCount), http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+	resp := SessionNextResponse{Records: []Record{}}
+	err := s.sessions.advance(mux.Vars(r)["id"], func(next uint64) (uint64, error) {
+		for len(resp.Records) < count {
+			record, err := s.Log.ReadContext(r.Context(), next)
+			if errors.Is(err, api.ErrOffsetOutOfRange{}) {
+				lowest, lerr := s.Log.LowestOffset()
+				if lerr != nil {
+					return 0, lerr
+				}
+				if next < lowest { // the log was truncated past the cursor
+					return 0, err
+				}
+				break // caught up with the log
+			}
+			if err != nil {
+				return 0, err
+			}
+			resp.Records = append(resp.Records, Record{
+				Value:       record.Value,
+				Offset:      record.Offset,
+				Undecodable: record.Undecodable,
+			})
+			next = record.Offset + 1
+		}
+		resp.NextOffset = next
+		return next, nil
+	})
+	var expired errSessionExpired
+	switch {
+	case errors.As(err, &expired):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(SessionExpiredResponse{Error: err.Error(), NextOffset: expired.Offset})
+		return
+	case err == errNoSession, errors.Is(err, api.ErrOffsetOutOfRange{}):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(resp) // return records and next offset
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// returns up to n records picked uniformly at random from the log's offsets, in offset order
+func (s *httpServer) handleSample(w http.ResponseWriter, r *http.Request) {
+	n := 100
+	if q := r.URL.Query().Get("n"); q != "" {
+		v, err := strconv.Atoi(q)
+		if err != nil || v < 1 || v > maxSampleCount {
+			http.Error(w, "n must be between 1 and "+strconv.Itoa(maxSampleCount), http.StatusBadRequest)
+			return
+		}
+		n = v
+	}
+	resp := SampleResponse{Records: []Record{}}
+	lowest, err := s.Log.LowestOffset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	highest, err := s.Log.HighestOffset()
+	if err != nil && err != log.ErrEmptyLog {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		ctx, cancel := context.WithTimeout(r.Context(), s.sampler.maxTime)
+		defer cancel()
+		read := 0
+		for _, off := range s.sampler.offsets(lowest, highest, n) {
+			// the record's size is checked against the budget before it's read
+			size, err := s.Log.RecordSize(off)
+			if errors.Is(err, api.ErrOffsetOutOfRange{}) {
+				continue // truncated away since the range was read
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if read += int(size); read > s.sampler.maxBytes {
+				resp.Partial = true
+				break
+			}
+			record, err := s.Log.ReadContext(ctx, off) // found through the index, nothing is scanned
+			if errors.Is(err, api.ErrOffsetOutOfRange{}) {
+				continue
+			}
+			if ctx.Err() != nil {
+				resp.Partial = true
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp.Records = append(resp.Records, Record{
+				Value:       record.Value,
+				Offset:      record.Offset,
+				Undecodable: record.Undecodable,
+			})
+		}
+	}
+	if len(resp.Records) > 0 {
+		sizes := make([]int, 0, len(resp.Records))
+		for _, record := range resp.Records {
+			sizes = append(sizes, len(record.Value))
+		}
+		sort.Ints(sizes)
+		resp.Sizes = SampleSizes{Min: sizes[0], Median: sizes[len(sizes)/2], Max: sizes[len(sizes)-1]}
+	}
+	err = json.NewEncoder(w).Encode(resp) // return sample
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -0,0 +1,439 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/peytonrunyan/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsumeNextOffset(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http-test")
+	defer os.RemoveAll(dir)
+	srv, err := NewHTTPServer(":0", dir, log.Config{})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	for i := uint64(0); i < 3; i++ {
+		body, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	// next_offset should always be one past the consumed record
+	for i := uint64(0); i < 3; i++ {
+		body, err := json.Marshal(ConsumeRequest{Offset: i})
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		// the record's fields stay at the top level of the response
+		raw := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &raw))
+		require.Contains(t, raw, "value")
+		require.Contains(t, raw, "offset")
+		require.NotContains(t, raw, "record")
+
+		var resp ConsumeResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		require.Equal(t, i, resp.Record.Offset)
+		require.Equal(t, []byte("hello world"), resp.Record.Value)
+		require.Equal(t, i+1, resp.NextOffset)
+	}
+}
+
+// Records should survive the server being shut down and started again on the same directory
+func TestServerRestart(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http-test")
+	defer os.RemoveAll(dir)
+
+	srv, err := NewHTTPServer(":0", dir, log.Config{})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		body, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte(fmt.Sprintf("record %d", i))}})
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	require.NoError(t, srv.Shutdown(context.Background()))
+
+	srv, err = NewHTTPServer(":0", dir, log.Config{})
+	require.NoError(t, err)
+	defer srv.Close()
+	for i := uint64(0); i < 3; i++ {
+		body, err := json.Marshal(ConsumeRequest{Offset: i})
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var resp ConsumeResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		require.Equal(t, i, resp.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), resp.Value)
+	}
+
+	// an offset that hasn't been written is not found rather than a server error
+	body, err := json.Marshal(ConsumeRequest{Offset: 3})
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(body)))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestOffsets(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http-test")
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 2 * 12 // two records a segment
+
+	offsets := func(srv *HTTPServer) OffsetsResponse {
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/offsets", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp OffsetsResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		return resp
+	}
+	produce := func(srv *HTTPServer, n int) {
+		for i := 0; i < n; i++ {
+			body, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte("hello world")}})
+			require.NoError(t, err)
+			rec := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+			require.Equal(t, http.StatusOK, rec.Code)
+		}
+	}
+	highest := func(off uint64) *uint64 { return &off }
+
+	srv, err := NewHTTPServer(":0", dir, c)
+	require.NoError(t, err)
+
+	// an empty log has no highest offset
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/offsets", nil))
+	require.JSONEq(t, `{"lowest": 0, "highest": null}`, rec.Body.String())
+
+	produce(srv, 2) // a single segment
+	require.Equal(t, OffsetsResponse{Lowest: 0, Highest: highest(1)}, offsets(srv))
+
+	produce(srv, 3) // across three segments
+	require.Equal(t, OffsetsResponse{Lowest: 0, Highest: highest(4)}, offsets(srv))
+
+	require.NoError(t, srv.log.Truncate(2))
+	require.Equal(t, OffsetsResponse{Lowest: 2, Highest: highest(4)}, offsets(srv))
+	require.NoError(t, srv.Shutdown(context.Background()))
+
+	// the same after the segments are rebuilt from disk
+	srv, err = NewHTTPServer(":0", dir, c)
+	require.NoError(t, err)
+	defer srv.Close()
+	require.Equal(t, OffsetsResponse{Lowest: 2, Highest: highest(4)}, offsets(srv))
+}
+
+func TestSessions(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http-test")
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 3 * 12 // three records a segment
+	srv, err := NewHTTPServer(":0", dir, c)
+	require.NoError(t, err)
+	defer srv.Close()
+	now := time.Now()
+	srv.sessions.now = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		body, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte(fmt.Sprintf("record %d", i))}})
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	open := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/sessions", bytes.NewBufferString(body)))
+		return rec
+	}
+	next := func(id string, count int) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		url := fmt.Sprintf("/sessions/%s/next?count=%d", id, count)
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	rec := open("")
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var sess SessionResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&sess))
+	require.Equal(t, uint64(0), sess.Offset)
+
+	// walk the log four records at a time, crossing segments along the way
+	want := uint64(0)
+	for want < 10 {
+		rec = next(sess.ID, 4)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp SessionNextResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		require.NotEmpty(t, resp.Records)
+		for _, record := range resp.Records {
+			require.Equal(t, want, record.Offset)
+			require.Equal(t, []byte(fmt.Sprintf("record %d", want)), record.Value)
+			want++
+		}
+		require.Equal(t, want, resp.NextOffset)
+	}
+
+	// once caught up there's nothing to hand out, and the cursor stays put
+	rec = next(sess.ID, 4)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"records": [], "next_offset": 10}`, rec.Body.String())
+
+	// a session left idle past the TTL is gone, and says where it was up to
+	rec = open(`{"offset": 7}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&sess))
+	rec = next(sess.ID, 1)
+	require.Equal(t, http.StatusOK, rec.Code)
+	now = now.Add(sessionTTL + time.Second)
+	rec = next(sess.ID, 1)
+	require.Equal(t, http.StatusGone, rec.Code)
+	var expired SessionExpiredResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&expired))
+	require.Equal(t, uint64(8), expired.NextOffset)
+
+	// the hint is enough to carry on consuming by offset
+	body, err := json.Marshal(ConsumeRequest{Offset: expired.NextOffset})
+	require.NoError(t, err)
+	rec = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// and eventually it's forgotten altogether
+	now = now.Add(2 * sessionTTL)
+	require.Equal(t, http.StatusNotFound, next(sess.ID, 1).Code)
+
+	// each client can only hold so many sessions at once
+	for i := 0; i < maxSessionsPerClient; i++ {
+		require.Equal(t, http.StatusCreated, open("").Code)
+	}
+	require.Equal(t, http.StatusTooManyRequests, open("").Code)
+	require.Equal(t, http.StatusBadRequest, next(sess.ID, 0).Code)
+}
+
+// A session that's reading doesn't hold up requests against other sessions, but a second
+// request against it waits its turn.
+func TestSessionsAdvanceConcurrently(t *testing.T) {
+	sessions := newSessions(sessionTTL, maxSessionsPerClient)
+	slow, err := sessions.open("client", 0)
+	require.NoError(t, err)
+	fast, err := sessions.open("client", 0)
+	require.NoError(t, err)
+
+	reading := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- sessions.advance(slow, func(next uint64) (uint64, error) {
+			close(reading)
+			<-release
+			return next + 1, nil
+		})
+	}()
+	<-reading
+	require.NoError(t, sessions.advance(fast, func(next uint64) (uint64, error) {
+		return next + 1, nil
+	}))
+
+	var second uint64
+	go func() {
+		done <- sessions.advance(slow, func(next uint64) (uint64, error) {
+			second = next
+			return next + 1, nil
+		})
+	}()
+	close(release)
+	require.NoError(t, <-done)
+	require.NoError(t, <-done)
+	require.Equal(t, uint64(1), second) // the first request moved the cursor before the second read
+}
+
+// A log opened degraded refuses produce and says why in its stats
+func TestDegraded(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http-test")
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 12 // one record a segment
+	srv, err := NewHTTPServer(":0", dir, c)
+	require.NoError(t, err)
+	produce := func() int {
+		body, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		return rec.Code
+	}
+	for i := 0; i < 2; i++ {
+		require.Equal(t, http.StatusOK, produce())
+	}
+	require.NoError(t, srv.Shutdown(context.Background()))
+	require.NoError(t, os.Remove(path.Join(dir, "0.index")))
+
+	c.Integrity.Check = log.IntegrityQuick
+	_, err = NewHTTPServer(":0", dir, c)
+	require.Error(t, err)
+
+	c.Integrity.ServeDegraded = true
+	srv, err = NewHTTPServer(":0", dir, c)
+	require.NoError(t, err)
+	defer srv.Close()
+	require.Equal(t, http.StatusServiceUnavailable, produce())
+
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/stats", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var stats StatsResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&stats))
+	require.True(t, stats.Degraded)
+	require.Len(t, stats.Damage, 1)
+	require.Equal(t, uint64(0), stats.Damage[0].BaseOffset)
+
+	// what's left can still be consumed
+	body, err := json.Marshal(ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	rec = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+// Offsets past the head and below a truncated tail are both 404s that name the offset
+func TestConsumeOutOfRange(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http-test")
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 2 * 12 // two records a segment
+	srv, err := NewHTTPServer(":0", dir, c)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	for i := 0; i < 6; i++ {
+		body, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	require.NoError(t, srv.log.Truncate(4)) // drops the first two segments
+
+	for _, off := range []uint64{6, 100, 0, 3} {
+		body, err := json.Marshal(ConsumeRequest{Offset: off})
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(body)))
+		require.Equal(t, http.StatusNotFound, rec.Code, off)
+		require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		var resp OutOfRangeResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		require.Equal(t, off, resp.Offset)
+		require.Contains(t, resp.Error, "out of range")
+	}
+}
+
+func TestSample(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "http-test")
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 12 * 10 // 10 records to a segment
+	srv, err := NewHTTPServer(":0", dir, c)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	sample := func(query string) (SampleResponse, int) {
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sample"+query, nil))
+		var resp SampleResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		}
+		return resp, rec.Code
+	}
+
+	resp, code := sample("")
+	require.Equal(t, http.StatusOK, code)
+	require.Empty(t, resp.Records)
+	require.False(t, resp.Partial)
+
+	// the record at offset i has a value i+1 bytes long
+	for i := 0; i < 100; i++ {
+		body, err := json.Marshal(ProduceRequest{Record: Record{Value: bytes.Repeat([]byte("x"), i+1)}})
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	srv.sampler.rand = rand.New(rand.NewSource(1))
+	resp, code = sample("?n=30")
+	require.Equal(t, http.StatusOK, code)
+	require.False(t, resp.Partial)
+	require.Len(t, resp.Records, 30)
+	segments := make(map[uint64]bool)
+	for i, record := range resp.Records {
+		if i > 0 {
+			require.Greater(t, record.Offset, resp.Records[i-1].Offset)
+		}
+		require.Len(t, record.Value, int(record.Offset)+1)
+		segments[record.Offset/10] = true
+	}
+	require.GreaterOrEqual(t, len(segments), 5) // spread across the log, not bunched in one segment
+	require.Equal(t, len(resp.Records[0].Value), resp.Sizes.Min)
+	require.Equal(t, len(resp.Records[15].Value), resp.Sizes.Median)
+	require.Equal(t, len(resp.Records[29].Value), resp.Sizes.Max)
+
+	// asking for more than there is returns everything
+	resp, _ = sample("?n=1000")
+	require.Len(t, resp.Records, 100)
+	require.False(t, resp.Partial)
+	require.Equal(t, SampleSizes{Min: 1, Median: 51, Max: 100}, resp.Sizes)
+
+	// the byte limit cuts the sample short, counting records as they're stored
+	srv.sampler.maxBytes = 200
+	resp, _ = sample("?n=100")
+	require.True(t, resp.Partial)
+	read := 0
+	for _, record := range resp.Records {
+		size, err := srv.log.RecordSize(record.Offset)
+		require.NoError(t, err)
+		require.Greater(t, int(size), len(record.Value))
+		read += int(size)
+	}
+	require.LessOrEqual(t, read, 200)
+	require.NotEmpty(t, resp.Records)
+
+	// and so does the time limit
+	srv.sampler.maxBytes = sampleMaxBytes
+	srv.sampler.maxTime = 0
+	resp, _ = sample("?n=100")
+	require.True(t, resp.Partial)
+	require.Empty(t, resp.Records)
+
+	for _, query := range []string{"?n=0", "?n=1001", "?n=x"} {
+		_, code = sample(query)
+		require.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
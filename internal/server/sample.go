@@ -0,0 +1,56 @@
+package server
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxSampleCount = 1000            // most records a sample may ask for
+	sampleMaxBytes = 4 << 20         // most bytes of records, as stored, a sample reads
+	sampleMaxTime  = 2 * time.Second // how long a sample may spend reading
+)
+
+// How the sample endpoint picks offsets and how much it may read. Samples that hit either limit
+// return what they've read so far, marked partial.
+type sampler struct {
+	mu       sync.Mutex
+	rand     *rand.Rand // replaced in tests so the offsets picked are known
+	maxBytes int
+	maxTime  time.Duration
+}
+
+func newSampler(maxBytes int, maxTime time.Duration) *sampler {
+	return &sampler{
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		maxBytes: maxBytes,
+		maxTime:  maxTime,
+	}
+}
+
+// Picks n distinct offsets uniformly at random from [lowest, highest], in ascending order. If
+// the range holds n offsets or fewer, all of them are returned.
+func (s *sampler) offsets(lowest, highest uint64, n int) []uint64 {
+	span := highest - lowest + 1
+	if span <= uint64(n) {
+		offsets := make([]uint64, 0, span)
+		for off := lowest; off <= highest; off++ {
+			offsets = append(offsets, off)
+		}
+		return offsets
+	}
+	s.mu.Lock()
+	picked := make(map[uint64]bool, n)
+	for len(picked) < n {
+		picked[lowest+uint64(s.rand.Int63n(int64(span)))] = true
+	}
+	s.mu.Unlock()
+	offsets := make([]uint64, 0, n)
+	for off := range picked {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	sessionTTL           = 5 * time.Minute // how long a session can sit idle before it's expired
+	maxSessionsPerClient = 16              // how many live sessions a single client may hold
+)
+
+var (
+	errSessionLimit = errors.New("too many open sessions for this client")
+	errNoSession    = errors.New("no such session")
+)
+
+// Returned by get when the session existed but has expired. Offset is the last position the
+// session's cursor was at, so the client can carry on by paging with offsets itself.
+type errSessionExpired struct {
+	Offset uint64
+}
+
+func (e errSessionExpired) Error() string {
+	return "session expired"
+}
+
+// A consume cursor kept on the server, so clients that don't want to track offsets themselves
+// can just ask for what's next. next and lastUsed are only changed with both mu and the sessions'
+// mutex held, so either is enough to read them.
+type session struct {
+	mu       sync.Mutex // held while a request reads the session's records
+	client   string
+	next     uint64    // offset of the next record to hand out
+	lastUsed time.Time // sessions idle for longer than the TTL are expired
+}
+
+// The sessions open against the log. Cursors are only kept in memory, they don't survive a
+// restart. Expired sessions are remembered for another TTL so their clients get told where they
+// were up to, then forgotten entirely.
+type sessions struct {
+	mu        sync.Mutex
+	byID      map[string]*session
+	ttl       time.Duration
+	perClient int
+	now       func() time.Time // replaced in tests to move time along
+}
+
+func newSessions(ttl time.Duration, perClient int) *sessions {
+	return &sessions{
+		byID:      make(map[string]*session),
+		ttl:       ttl,
+		perClient: perClient,
+		now:       time.Now,
+	}
+}
+
+// Opens a session for client with its cursor at next, and returns its ID.
+func (s *sessions) open(client string, next uint64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	open := 0
+	for _, sess := range s.byID {
+		if sess.client == client && !s.expired(sess) {
+			open++
+		}
+	}
+	if open >= s.perClient {
+		return "", errSessionLimit
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	s.byID[id] = &session{client: client, next: next, lastUsed: s.now()}
+	return id, nil
+}
+
+// Runs fn with the cursor of the session with the given ID, and moves the cursor to whatever fn
+// returns. Returns errNoSession for IDs it doesn't know of and errSessionExpired for sessions
+// that have sat idle too long.
+//
+// The session's own lock is held while fn runs, so requests against the same session don't hand
+// out the same records twice. The sessions' mutex is only held to look the session up and to
+// move its cursor, so a slow read doesn't hold up other sessions.
+func (s *sessions) advance(id string, fn func(next uint64) (uint64, error)) error {
+	s.mu.Lock()
+	s.sweep()
+	sess, ok := s.byID[id]
+	s.mu.Unlock()
+	if !ok {
+		return errNoSession
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if s.expired(sess) {
+		return errSessionExpired{Offset: sess.next}
+	}
+	next, err := fn(sess.next)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	sess.next = next
+	sess.lastUsed = s.now()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *sessions) expired(sess *session) bool {
+	return s.now().Sub(sess.lastUsed) > s.ttl
+}
+
+// Forgets sessions that have been expired for longer than the TTL. The caller must hold the
+// mutex.
+func (s *sessions) sweep() {
+	for id, sess := range s.byID {
+		if s.now().Sub(sess.lastUsed) > 2*s.ttl {
+			delete(s.byID, id)
+		}
+	}
+}